@@ -0,0 +1,253 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// certLoader serves the certificate in a pair of PEM files and reloads it
+// when the files change, for example when cert-manager or the kubelet
+// rotates a mounted Secret. If the new files cannot be loaded, the previous
+// certificate is kept.
+type certLoader struct {
+	certFile, keyFile string
+	// hostname, if set, must be covered by the certificate's SANs.
+	hostname string
+	// roots, if set, is the pool the certificate chain must build to.
+	roots *x509.CertPool
+
+	cert atomic.Pointer[tls.Certificate]
+	// certPEM and keyPEM are the contents the current certificate was loaded
+	// from, and badCertPEM and badKeyPEM the last contents that can never
+	// load, such as a key that does not match the certificate. They are used
+	// to detect changes. Contents rejected for reasons that depend on the
+	// time, such as a certificate that is not yet valid, are checked again on
+	// every reload.
+	certPEM, keyPEM       []byte
+	badCertPEM, badKeyPEM []byte
+}
+
+// newCertLoader loads the certificate in certFile and keyFile, failing if it
+// is not valid for hostname or its chain does not build to roots. An empty
+// hostname or nil roots are not checked.
+func newCertLoader(certFile, keyFile, hostname string, roots *x509.CertPool) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile, hostname: hostname, roots: roots}
+	if _, err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetCertificate returns the current certificate. It is meant to be used as
+// tls.Config.GetCertificate.
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.cert.Load(), nil
+}
+
+// reload reads the certificate and key files and, if they changed, validates
+// them and replaces the current certificate. It reports whether the
+// certificate was replaced.
+func (l *certLoader) reload() (bool, error) {
+	changed, err := l.load()
+	switch {
+	case err != nil:
+		certReloads.WithLabelValues("failed").Inc()
+	case changed:
+		certReloads.WithLabelValues("loaded").Inc()
+	default:
+		certReloads.WithLabelValues("unchanged").Inc()
+	}
+	return changed, err
+}
+
+func (l *certLoader) load() (bool, error) {
+	certPEM, err := os.ReadFile(l.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(l.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(certPEM, l.certPEM) && bytes.Equal(keyPEM, l.keyPEM) ||
+		bytes.Equal(certPEM, l.badCertPEM) && bytes.Equal(keyPEM, l.badKeyPEM) {
+		return false, nil
+	}
+
+	cert, err := parseKeyPair(certPEM, keyPEM, l.hostname)
+	if err != nil {
+		l.badCertPEM, l.badKeyPEM = certPEM, keyPEM
+		return false, err
+	}
+	if err := checkValidity(cert.Leaf, time.Now()); err != nil {
+		return false, err
+	}
+	if l.roots != nil {
+		// the chain is verified at the current time, so failures are not
+		// remembered either
+		if _, err := verifyChain(cert, l.roots); err != nil {
+			return false, err
+		}
+	}
+	l.cert.Store(cert)
+	l.certPEM, l.keyPEM = certPEM, keyPEM
+	log.Printf("Loaded certificate %q (SANs: %s), valid until %s", cert.Leaf.Subject, strings.Join(sans(cert.Leaf), ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return true, nil
+}
+
+// watch checks the certificate files for changes every interval. Secrets are
+// updated by swapping a symlink, which not every file notification mechanism
+// reports, so the files are polled.
+func (l *certLoader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := l.reload(); err != nil {
+			log.Printf("Failed to reload certificate, keeping the current one: %v", err)
+		}
+	}
+}
+
+// parseKeyPair parses a PEM certificate chain and private key, checks that
+// they match and, unless hostname is empty, that the leaf certificate is
+// valid for hostname. The errors name the specific problem, so that a
+// misconfigured Secret can be fixed from the logs. The validity period is
+// checked separately by checkValidity.
+func parseKeyPair(certPEM, keyPEM []byte, hostname string) (*tls.Certificate, error) {
+	leaf, err := parseLeaf(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+		return nil, fmt.Errorf("private key does not match the public key of certificate %q", leaf.Subject)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	if hostname != "" {
+		if err := leaf.VerifyHostname(hostname); err != nil {
+			return nil, fmt.Errorf("certificate %q has no SAN for %q (SANs: %s)", leaf.Subject, hostname, strings.Join(sans(leaf), ", "))
+		}
+	}
+	return &cert, nil
+}
+
+// checkValidity checks that leaf is valid at now.
+func checkValidity(leaf *x509.Certificate, now time.Time) error {
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate %q expired at %s", leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate %q is not valid until %s", leaf.Subject, leaf.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// verifyChain checks that the leaf of cert chains to roots through the
+// intermediates sent with it, and returns the verified chains.
+func verifyChain(cert *tls.Certificate, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for i, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %d of the chain: %v", i+1, err)
+		}
+		intermediates.AddCert(c)
+	}
+	chains, err := cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("certificate %q does not chain to a trusted root: %v", cert.Leaf.Subject, err)
+	}
+	return chains, nil
+}
+
+// parseLeaf parses the first certificate in certPEM.
+func parseLeaf(certPEM []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return nil, errors.New("no PEM CERTIFICATE block found in the certificate file")
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate: %v", err)
+			}
+			return cert, nil
+		}
+	}
+}
+
+// parsePrivateKey parses the first private key in keyPEM, in any of the
+// encodings accepted by tls.X509KeyPair.
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, keyPEM = pem.Decode(keyPEM)
+		if block == nil {
+			return nil, errors.New("no PEM PRIVATE KEY block found in the key file")
+		}
+		if block.Type != "PRIVATE KEY" && !strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			continue
+		}
+		if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			if signer, ok := key.(crypto.Signer); ok {
+				return signer, nil
+			}
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+		if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+		return nil, fmt.Errorf("failed to parse %s", block.Type)
+	}
+}
+
+// sans returns the DNS names and IP addresses a certificate is valid for.
+func sans(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		names = append(names, "none")
+	}
+	return names
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	return newCA(t, "Test CA", nil)
+}
+
+// intermediate returns a CA signed by ca.
+func (ca *testCA) intermediate(t *testing.T) *testCA {
+	t.Helper()
+	return newCA(t, "Test Intermediate CA", ca)
+}
+
+// newCA returns a CA named name, signed by parent or, if parent is nil, by
+// itself.
+func newCA(t *testing.T, name string, parent *testCA) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	issuer, signer := tmpl, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// pool returns a pool holding only the CA certificate.
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a PEM leaf certificate for localhost with the given serial
+// and validity, signed by ca, and its PEM private key.
+func (ca *testCA) issue(t *testing.T, serial int64, notBefore, notAfter time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeKeyPair writes certPEM and keyPEM to certFile and keyFile.
+func writeKeyPair(t *testing.T, certFile, keyFile string, certPEM, keyPEM []byte) {
+	t.Helper()
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertLoaderReload(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	certPEM, keyPEM := ca.issue(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	l, err := newCertLoader(certFile, keyFile, "localhost", ca.pool())
+	if err != nil {
+		t.Fatalf("newCertLoader: %v", err)
+	}
+	serial := func() int64 { return l.cert.Load().Leaf.SerialNumber.Int64() }
+	if serial() != 1 {
+		t.Fatalf("serial = %d, want 1", serial())
+	}
+
+	if changed, err := l.reload(); changed || err != nil {
+		t.Errorf("reload of unchanged files = %v, %v, want false, nil", changed, err)
+	}
+
+	// rotation
+	certPEM, keyPEM = ca.issue(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	if changed, err := l.reload(); !changed || err != nil {
+		t.Fatalf("reload of rotated files = %v, %v, want true, nil", changed, err)
+	}
+	if serial() != 2 {
+		t.Errorf("serial after rotation = %d, want 2", serial())
+	}
+
+	// the previous certificate is kept whenever the new files are rejected
+	otherCert, otherKey := ca.issue(t, 3, now.Add(-time.Hour), now.Add(time.Hour))
+	expiredCert, expiredKey := ca.issue(t, 4, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	for _, tc := range []struct {
+		name            string
+		certPEM, keyPEM []byte
+		want            string
+	}{
+		{"key mismatch", otherCert, keyPEM, "private key does not match"},
+		{"expired", expiredCert, expiredKey, "expired at"},
+		{"not a certificate", []byte("garbage"), otherKey, "no PEM CERTIFICATE block"},
+		{"untrusted", selfSigned(t, otherKey), otherKey, "does not chain to a trusted root"},
+	} {
+		writeKeyPair(t, certFile, keyFile, tc.certPEM, tc.keyPEM)
+		changed, err := l.reload()
+		if changed || err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: reload = %v, %v, want an error containing %q", tc.name, changed, err, tc.want)
+		}
+		if serial() != 2 {
+			t.Errorf("%s: serial = %d, want the previous certificate 2", tc.name, serial())
+		}
+	}
+
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.reload(); err == nil {
+		t.Error("reload with a missing key file succeeded, want an error")
+	}
+	if serial() != 2 {
+		t.Errorf("missing key file: serial = %d, want the previous certificate 2", serial())
+	}
+}
+
+func TestNewCertLoaderRejectsInvalidCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	certPEM, keyPEM := ca.issue(t, 1, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	if _, err := newCertLoader(certFile, keyFile, "", nil); err == nil || !strings.Contains(err.Error(), "expired at") {
+		t.Errorf("newCertLoader with an expired certificate = %v, want an expiry error", err)
+	}
+
+	certPEM, keyPEM = ca.issue(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	if _, err := newCertLoader(certFile, keyFile, "example.com", nil); err == nil || !strings.Contains(err.Error(), `has no SAN for "example.com"`) {
+		t.Errorf("newCertLoader with a wrong hostname = %v, want a SAN error", err)
+	}
+}
+
+// selfSigned returns a PEM certificate for localhost signed by the private
+// key in keyPEM itself.
+func selfSigned(t *testing.T, keyPEM []byte) []byte {
+	t.Helper()
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(5),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestCertLoaderRetriesTimeDependentFailures(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	certPEM, keyPEM := ca.issue(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	l, err := newCertLoader(certFile, keyFile, "", nil)
+	if err != nil {
+		t.Fatalf("newCertLoader: %v", err)
+	}
+
+	// a key that does not match is remembered and not reported again
+	otherCert, _ := ca.issue(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, otherCert, keyPEM)
+	if _, err := l.reload(); err == nil {
+		t.Fatal("reload with a mismatched key succeeded, want an error")
+	}
+	if changed, err := l.reload(); changed || err != nil {
+		t.Errorf("second reload with a mismatched key = %v, %v, want false, nil", changed, err)
+	}
+
+	// a certificate that is not yet valid is loaded once it becomes valid
+	// certificate times have a resolution of a second
+	notBefore := time.Now().Truncate(time.Second).Add(2 * time.Second)
+	certPEM, keyPEM = ca.issue(t, 3, notBefore, notBefore.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	if _, err := l.reload(); err == nil || !strings.Contains(err.Error(), "is not valid until") {
+		t.Fatalf("reload of a certificate that is not yet valid = %v, want a validity error", err)
+	}
+	time.Sleep(time.Until(notBefore) + 10*time.Millisecond)
+	if changed, err := l.reload(); !changed || err != nil {
+		t.Errorf("reload once the certificate is valid = %v, %v, want true, nil", changed, err)
+	}
+	if got := l.cert.Load().Leaf.SerialNumber.Int64(); got != 3 {
+		t.Errorf("serial = %d, want 3", got)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	root := newTestCA(t)
+	inter := root.intermediate(t)
+	now := time.Now()
+	leafPEM, keyPEM := inter.issue(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	interPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: inter.cert.Raw})
+
+	cert, err := parseKeyPair(append(leafPEM, interPEM...), keyPEM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chains, err := verifyChain(cert, root.pool())
+	if err != nil {
+		t.Fatalf("verifyChain with the intermediate: %v", err)
+	}
+	if len(chains[0]) != 3 || !chains[0][1].Equal(inter.cert) || !chains[0][2].Equal(root.cert) {
+		t.Errorf("verified chain has %d certificates, want leaf, intermediate and root", len(chains[0]))
+	}
+	if _, err := verifyChain(cert, inter.pool()); err != nil {
+		t.Errorf("verifyChain against the intermediate as root: %v", err)
+	}
+	if _, err := verifyChain(cert, newTestCA(t).pool()); err == nil || !strings.Contains(err.Error(), "does not chain to a trusted root") {
+		t.Errorf("verifyChain against another root = %v, want a trust error", err)
+	}
+
+	// without the intermediate, the chain does not build to the root
+	leafOnly, err := parseKeyPair(leafPEM, keyPEM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyChain(leafOnly, root.pool()); err == nil {
+		t.Error("verifyChain without the intermediate succeeded, want an error")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// certInfo describes a certificate in the chain reported by /certz.
+type certInfo struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	Serial            string    `json:"serial"`
+	NotBefore         time.Time `json:"notBefore"`
+	NotAfter          time.Time `json:"notAfter"`
+	DNSNames          []string  `json:"dnsNames,omitempty"`
+	IPAddresses       []string  `json:"ipAddresses,omitempty"`
+	IsCA              bool      `json:"isCA"`
+	SHA256Fingerprint string    `json:"sha256Fingerprint"`
+}
+
+func newCertInfo(cert *x509.Certificate) certInfo {
+	info := certInfo{
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		Serial:            serialHex(cert.SerialNumber),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		DNSNames:          cert.DNSNames,
+		IsCA:              cert.IsCA,
+		SHA256Fingerprint: fingerprint(cert.Raw),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// serialHex formats a certificate serial number as hex, as printed by
+// openssl.
+func serialHex(serial *big.Int) string {
+	return fmt.Sprintf("%X", serial)
+}
+
+// certz serves the chain of the certificate currently served by certs as
+// JSON, along with the time left until the leaf certificate expires.
+func certz(certs *certLoader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cert := certs.cert.Load()
+		resp := struct {
+			ExpiresIn string     `json:"expiresIn"`
+			Chain     []certInfo `json:"chain"`
+		}{
+			ExpiresIn: time.Until(cert.Leaf.NotAfter).Round(time.Second).String(),
+		}
+		for i, der := range cert.Certificate {
+			c := cert.Leaf
+			if i > 0 {
+				var err error
+				if c, err = x509.ParseCertificate(der); err != nil {
+					http.Error(w, fmt.Sprintf("failed to parse certificate %d of the chain: %v", i, err), http.StatusInternalServerError)
+					return
+				}
+			}
+			resp.Chain = append(resp.Chain, newCertInfo(c))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp); err != nil {
+			log.Printf("Failed to write /certz response: %v", err)
+		}
+	}
+}
+
+// healthz reports that the server is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz returns a handler that fails once the certificate served by certs
+// expires within window, so that the Pod is taken out of rotation before
+// clients see an expired certificate.
+func readyz(certs *certLoader, window time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leaf := certs.cert.Load().Leaf
+		if left := time.Until(leaf.NotAfter); left < window {
+			http.Error(w, fmt.Sprintf("certificate %q expires at %s, within the readiness window of %s",
+				leaf.Subject, leaf.NotAfter.Format(time.RFC3339), window), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newChainLoader returns a certLoader serving a leaf certificate that
+// expires at notAfter, issued by an intermediate CA and sent with it.
+func newChainLoader(t *testing.T, notAfter time.Time) (*certLoader, *testCA) {
+	t.Helper()
+	inter := newTestCA(t).intermediate(t)
+	leafPEM, keyPEM := inter.issue(t, 0xABCDEF, time.Now().Add(-time.Hour), notAfter)
+	interPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: inter.cert.Raw})
+	cert, err := parseKeyPair(append(leafPEM, interPEM...), keyPEM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &certLoader{}
+	l.cert.Store(cert)
+	return l, inter
+}
+
+func TestCertCollector(t *testing.T) {
+	notAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	l, _ := newChainLoader(t, notAfter)
+
+	want := fmt.Sprintf(`
+# HELP hello_app_tls_certificate_not_after_timestamp_seconds Expiry time of the served certificate in seconds since the Unix epoch.
+# TYPE hello_app_tls_certificate_not_after_timestamp_seconds gauge
+hello_app_tls_certificate_not_after_timestamp_seconds{issuer="CN=Test Intermediate CA",serial="ABCDEF",subject="CN=localhost"} %d
+`, notAfter.Unix())
+	if err := testutil.CollectAndCompare(certCollector{l}, strings.NewReader(want),
+		"hello_app_tls_certificate_not_after_timestamp_seconds"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(certCollector{l}, "hello_app_tls_certificate_expiry_days"); n != 1 {
+		t.Errorf("got %d expiry days metrics, want 1", n)
+	}
+}
+
+func TestCertz(t *testing.T) {
+	l, inter := newChainLoader(t, time.Now().Add(48*time.Hour))
+	rec := httptest.NewRecorder()
+	certz(l).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/certz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var resp struct {
+		ExpiresIn string     `json:"expiresIn"`
+		Chain     []certInfo `json:"chain"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid /certz response %q: %v", rec.Body, err)
+	}
+	if len(resp.Chain) != 2 {
+		t.Fatalf("chain has %d certificates, want the leaf and the intermediate", len(resp.Chain))
+	}
+	leaf, ca := resp.Chain[0], resp.Chain[1]
+	if leaf.Subject != "CN=localhost" || leaf.Issuer != "CN=Test Intermediate CA" || leaf.Serial != "ABCDEF" || leaf.IsCA {
+		t.Errorf("leaf = %+v", leaf)
+	}
+	if ca.Subject != "CN=Test Intermediate CA" || ca.Issuer != "CN=Test CA" || !ca.IsCA ||
+		ca.SHA256Fingerprint != fingerprint(inter.cert.Raw) {
+		t.Errorf("intermediate = %+v", ca)
+	}
+	if d, err := time.ParseDuration(resp.ExpiresIn); err != nil || d < 47*time.Hour || d > 48*time.Hour {
+		t.Errorf("expiresIn = %q, want about 48h", resp.ExpiresIn)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	l, _ := newChainLoader(t, time.Now().Add(time.Hour))
+	for _, tc := range []struct {
+		window time.Duration
+		want   int
+	}{
+		{30 * time.Minute, http.StatusOK},
+		{2 * time.Hour, http.StatusServiceUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		readyz(l, tc.window).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != tc.want {
+			t.Errorf("window %s: status = %d, want %d (%s)", tc.window, rec.Code, tc.want, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIPHeaders are the headers the client IP can be read from.
+var clientIPHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"}
+
+// proxyResolver determines the client IP of a request from the header set by
+// a chain of trusted proxies. Only the one header the proxies set is read,
+// and it is only believed as far as the addresses that appended to it are
+// trusted, so clients cannot spoof their IP by sending the headers
+// themselves.
+type proxyResolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// newProxyResolver parses a comma-separated list of CIDRs or IP addresses of
+// trusted proxies, which set header, one of clientIPHeaders.
+func newProxyResolver(cidrs, header string) (*proxyResolver, error) {
+	trusted, err := parsePrefixes(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range clientIPHeaders {
+		if strings.EqualFold(h, header) {
+			return &proxyResolver{trusted: trusted, header: h}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown client IP header %q, must be one of %s", header, strings.Join(clientIPHeaders, ", "))
+}
+
+func (p *proxyResolver) isTrusted(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
+	}
+	return containsAddr(p.trusted, addr)
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs or IP addresses.
+func parsePrefixes(cidrs string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range splitList(cidrs) {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", s, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether addr is in any of prefixes.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the result of resolving the client IP of a request.
+type clientIP struct {
+	// IP is the resolved client IP.
+	IP string
+	// Source is the header the chain was read from, or empty if the request
+	// did not carry it.
+	Source string
+	// Chain is the forwarding chain from the original client on the left to
+	// the peer address of the connection on the right.
+	Chain []string
+	// Trusted are the addresses at the end of the chain that were trusted.
+	Trusted []string
+}
+
+// resolve walks the forwarding chain of r from the right, skipping trusted
+// proxies, and returns the first untrusted address as the client IP. The
+// chain is read from the configured header only; other forwarding headers
+// are ignored, as the client may have sent them.
+func (p *proxyResolver) resolve(r *http.Request) clientIP {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	var c clientIP
+	if values := r.Header.Values(p.header); len(values) > 0 {
+		c.Source = p.header
+		switch p.header {
+		case "Forwarded":
+			c.Chain = parseForwarded(values)
+		case "X-Forwarded-For":
+			c.Chain = splitList(strings.Join(values, ","))
+		case "X-Real-IP":
+			// the proxy sets a single address; a client-sent copy would
+			// come first
+			c.Chain = []string{strings.TrimSpace(values[len(values)-1])}
+		}
+	}
+	c.Chain = append(c.Chain, peer)
+
+	c.IP = c.Chain[0]
+	for i := len(c.Chain) - 1; i >= 0; i-- {
+		if i == 0 || !p.isTrusted(c.Chain[i]) {
+			c.IP = c.Chain[i]
+			break
+		}
+		c.Trusted = append([]string{c.Chain[i]}, c.Trusted...)
+	}
+	return c
+}
+
+// parseForwarded returns the for= addresses of the RFC 7239 Forwarded
+// header values, with quotes, brackets and ports removed. Obfuscated
+// identifiers and "unknown" are returned as they are.
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(name, "for") {
+					continue
+				}
+				value = strings.Trim(value, `"`)
+				if host, _, err := net.SplitHostPort(value); err == nil {
+					value = host
+				}
+				chain = append(chain, strings.Trim(value, "[]"))
+			}
+		}
+	}
+	return chain
+}
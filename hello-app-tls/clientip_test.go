@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted string
+		header  string
+		remote  string
+		headers http.Header
+		want    string
+		trust   []string
+	}{
+		{
+			name:   "no headers",
+			header: "X-Forwarded-For", remote: "203.0.113.7:1234",
+			want: "203.0.113.7",
+		},
+		{
+			name:    "untrusted peer",
+			header:  "X-Forwarded-For",
+			remote:  "203.0.113.7:1234",
+			headers: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "trusted proxy",
+			trusted: "10.0.0.0/8", header: "X-Forwarded-For",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "198.51.100.1", trust: []string{"10.0.0.2"},
+		},
+		{
+			name:    "spoofed X-Forwarded-For entry left of the proxy's",
+			trusted: "10.0.0.0/8", header: "X-Forwarded-For",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"X-Forwarded-For": {"192.0.2.66, 198.51.100.1"}},
+			want:    "198.51.100.1", trust: []string{"10.0.0.2"},
+		},
+		{
+			name:    "chain of trusted proxies",
+			trusted: "10.0.0.0/8,35.191.0.0/16", header: "X-Forwarded-For",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"X-Forwarded-For": {"198.51.100.1, 35.191.1.1"}},
+			want:    "198.51.100.1", trust: []string{"35.191.1.1", "10.0.0.2"},
+		},
+		{
+			name:    "spoofed X-Real-IP with X-Forwarded-For configured",
+			trusted: "10.0.0.0/8", header: "X-Forwarded-For",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"192.0.2.66"}},
+			want:    "198.51.100.1", trust: []string{"10.0.0.2"},
+		},
+		{
+			name:    "spoofed Forwarded with X-Forwarded-For configured",
+			trusted: "10.0.0.0/8", header: "X-Forwarded-For",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=192.0.2.66"}},
+			want:    "198.51.100.1", trust: []string{"10.0.0.2"},
+		},
+		{
+			name:    "configured header missing, others spoofed",
+			trusted: "10.0.0.0/8", header: "X-Real-IP",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"X-Forwarded-For": {"192.0.2.66"}, "Forwarded": {"for=192.0.2.66"}},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "X-Real-IP",
+			trusted: "10.0.0.0/8", header: "X-Real-IP",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"X-Real-Ip": {"198.51.100.1"}},
+			want:    "198.51.100.1", trust: []string{"10.0.0.2"},
+		},
+		{
+			name:    "Forwarded with IPv6",
+			trusted: "10.0.0.0/8", header: "Forwarded",
+			remote:  "10.0.0.2:1234",
+			headers: http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https`}},
+			want:    "2001:db8::1", trust: []string{"10.0.0.2"},
+		},
+		{
+			name:    "IPv6 peer and proxies",
+			trusted: "2001:db8:ffff::/48", header: "X-Forwarded-For",
+			remote:  "[2001:db8:ffff::2]:1234",
+			headers: http.Header{"X-Forwarded-For": {"2001:db8::1, 2001:db8:ffff::1"}},
+			want:    "2001:db8::1", trust: []string{"2001:db8:ffff::1", "2001:db8:ffff::2"},
+		},
+		{
+			name:    "IPv4-mapped IPv6 peer",
+			trusted: "10.0.0.0/8", header: "X-Forwarded-For",
+			remote:  "[::ffff:10.0.0.2]:1234",
+			headers: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "198.51.100.1", trust: []string{"::ffff:10.0.0.2"},
+		},
+		{
+			name:    "untrusted IPv6 peer",
+			trusted: "10.0.0.0/8", header: "X-Forwarded-For",
+			remote:  "[2001:db8::2]:1234",
+			headers: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "2001:db8::2",
+		},
+	} {
+		p, err := newProxyResolver(tc.trusted, tc.header)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		req.Header = tc.headers
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		c := p.resolve(req)
+		if c.IP != tc.want {
+			t.Errorf("%s: client IP = %s, want %s (chain %v)", tc.name, c.IP, tc.want, c.Chain)
+		}
+		if !slices.Equal(c.Trusted, tc.trust) {
+			t.Errorf("%s: trusted = %v, want %v", tc.name, c.Trusted, tc.trust)
+		}
+	}
+}
+
+func TestNewProxyResolver(t *testing.T) {
+	if p, err := newProxyResolver("", "x-real-ip"); err != nil || p.header != "X-Real-IP" {
+		t.Errorf(`newProxyResolver("", "x-real-ip") = %+v, %v, want header X-Real-IP`, p, err)
+	}
+	if _, err := newProxyResolver("", "True-Client-IP"); err == nil {
+		t.Error("newProxyResolver with an unknown header succeeded, want an error")
+	}
+	if _, err := newProxyResolver("10.0.0.0/33", "X-Forwarded-For"); err == nil {
+		t.Error("newProxyResolver with an invalid CIDR succeeded, want an error")
+	}
+}
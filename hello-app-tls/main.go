@@ -15,45 +15,271 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	minVersion := flag.String("tls-min-version", os.Getenv("TLS_MIN_VERSION"), "minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	maxVersion := flag.String("tls-max-version", os.Getenv("TLS_MAX_VERSION"), "maximum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	ciphers := flag.String("tls-cipher-suites", os.Getenv("TLS_CIPHER_SUITES"), "comma-separated TLS 1.0-1.2 cipher suites to allow")
+	curves := flag.String("tls-curves", os.Getenv("TLS_CURVES"), "comma-separated curve preferences (X25519, P-256, P-384, P-521)")
+	alpn := flag.String("tls-alpn", os.Getenv("TLS_ALPN"), "comma-separated ALPN protocols to offer")
+	flag.Parse()
+	policy, err := parseTLSPolicy(*minVersion, *maxVersion, *ciphers, *curves, *alpn)
+	if err != nil {
+		log.Fatalf("invalid TLS policy: %v", err)
+	}
+
 	port := "8443"
 	if fromEnv := os.Getenv("PORT"); fromEnv != "" {
 		port = fromEnv
 	}
+	selfSigned := boolEnv("TLS_SELF_SIGNED")
 	tlsCert, tlsKey := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
-	if tlsCert == "" {
+	if selfSigned && (tlsCert != "" || tlsKey != "") {
+		log.Fatal("TLS_CERT and TLS_KEY cannot be set together with TLS_SELF_SIGNED")
+	}
+	if !selfSigned && tlsCert == "" {
 		log.Fatal("TLS_CERT environment variable must be set")
 	}
-	if tlsKey == "" {
+	if !selfSigned && tlsKey == "" {
 		log.Fatal("TLS_KEY environment variable must be set")
 	}
+	reloadInterval := 10 * time.Second
+	if fromEnv := os.Getenv("TLS_RELOAD_INTERVAL"); fromEnv != "" {
+		d, err := time.ParseDuration(fromEnv)
+		if err != nil || d <= 0 {
+			log.Fatalf("TLS_RELOAD_INTERVAL must be a positive duration, got %q", fromEnv)
+		}
+		reloadInterval = d
+	}
+	ocspInterval := time.Minute
+	if fromEnv := os.Getenv("TLS_OCSP_INTERVAL"); fromEnv != "" {
+		d, err := time.ParseDuration(fromEnv)
+		if err != nil || d <= 0 {
+			log.Fatalf("TLS_OCSP_INTERVAL must be a positive duration, got %q", fromEnv)
+		}
+		ocspInterval = d
+	}
+	expiryWindow := 24 * time.Hour
+	if fromEnv := os.Getenv("TLS_EXPIRY_WINDOW"); fromEnv != "" {
+		d, err := time.ParseDuration(fromEnv)
+		if err != nil || d < 0 {
+			log.Fatalf("TLS_EXPIRY_WINDOW must be a non-negative duration, got %q", fromEnv)
+		}
+		expiryWindow = d
+	}
+	var hsts string
+	if fromEnv := os.Getenv("HSTS_MAX_AGE"); fromEnv != "" {
+		maxAge, err := time.ParseDuration(fromEnv)
+		if err != nil || maxAge < 0 {
+			log.Fatalf("HSTS_MAX_AGE must be a non-negative duration, got %q", fromEnv)
+		}
+		hsts = hstsHeader(maxAge, boolEnv("HSTS_INCLUDE_SUBDOMAINS"), boolEnv("HSTS_PRELOAD"))
+	}
+
+	clientIPHeader := "X-Forwarded-For"
+	if fromEnv := os.Getenv("CLIENT_IP_HEADER"); fromEnv != "" {
+		clientIPHeader = fromEnv
+	}
+	proxies, err := newProxyResolver(os.Getenv("TRUSTED_PROXIES"), clientIPHeader)
+	if err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES or CLIENT_IP_HEADER: %v", err)
+	}
 
 	// register hello function to handle all requests
 	server := http.NewServeMux()
-	server.HandleFunc("/", hello)
+	server.HandleFunc("/", hello(proxies))
 
 	// start the web server on port and accept requests
-	log.Printf("tls cert: %s", tlsCert)
-	log.Printf("tls key: %s", tlsKey)
+	var roots *x509.CertPool
+	if rootCA := os.Getenv("TLS_ROOT_CA"); rootCA != "" {
+		if roots, err = loadCertPool(rootCA); err != nil {
+			log.Fatalf("failed to load TLS_ROOT_CA: %v", err)
+		}
+	}
+	var certs *certLoader
+	if selfSigned {
+		sans := splitList(os.Getenv("TLS_SELF_SIGNED_SANS"))
+		if len(sans) == 0 {
+			sans = defaultSANs()
+		}
+		if certs, err = newSelfSignedLoader(sans, os.Getenv("TLS_SELF_SIGNED_CA_FILE")); err != nil {
+			log.Fatalf("failed to generate self-signed certificate: %v", err)
+		}
+	} else {
+		if certs, err = newCertLoader(tlsCert, tlsKey, os.Getenv("TLS_HOSTNAME"), roots); err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+		go certs.watch(reloadInterval)
+	}
+	tlsConfig := &tls.Config{GetCertificate: certs.GetCertificate}
+	if boolEnv("TLS_OCSP_STAPLING") {
+		stapler := newOCSPStapler(certs, roots, os.Getenv("TLS_OCSP_RESPONDER"))
+		go stapler.run(ocspInterval)
+		tlsConfig.GetCertificate = stapler.GetCertificate
+	}
+	reg.MustRegister(certCollector{certs})
+	server.Handle("/metrics", metricsHandler())
+	server.HandleFunc("/certz", certz(certs))
+	server.HandleFunc("/healthz", healthz)
+	server.HandleFunc("/readyz", readyz(certs, expiryWindow))
+
+	// optionally ask clients for a certificate signed by TLS_CLIENT_CA
+	var handler http.Handler = server
+	clientAuth := os.Getenv("TLS_CLIENT_AUTH")
+	if clientCA := os.Getenv("TLS_CLIENT_CA"); clientCA != "" {
+		if clientAuth == "" {
+			clientAuth = "require"
+		}
+		if tlsConfig.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			log.Fatalf("failed to load TLS_CLIENT_CA: %v", err)
+		}
+	}
+	if clientAuth != "" {
+		mode, ok := clientAuthModes[clientAuth]
+		if !ok {
+			log.Fatalf("TLS_CLIENT_AUTH must be one of none, request, verify-if-given or require, got %q", clientAuth)
+		}
+		if mode >= tls.VerifyClientCertIfGiven && tlsConfig.ClientCAs == nil {
+			log.Fatalf("TLS_CLIENT_AUTH=%s requires TLS_CLIENT_CA to be set", clientAuth)
+		}
+		tlsConfig.ClientAuth = mode
+		if clientAuth == "require" {
+			handler = requireClientCert(handler)
+		}
+		log.Printf("Client certificate authentication: %s", clientAuth)
+	}
+
+	// optionally serve health checks and metrics in plaintext on a separate
+	// port, where kubelet probes and Prometheus need no client certificate
+	if monitoringPort := os.Getenv("MONITORING_PORT"); monitoringPort != "" {
+		monitoring := http.NewServeMux()
+		monitoring.Handle("/metrics", metricsHandler())
+		monitoring.HandleFunc("/healthz", healthz)
+		monitoring.HandleFunc("/readyz", readyz(certs, expiryWindow))
+		go func() {
+			log.Printf("Serving /healthz, /readyz and /metrics on port %s", monitoringPort)
+			log.Fatal(http.ListenAndServe(":"+monitoringPort, monitoring))
+		}()
+	} else if clientAuth == "require" {
+		log.Print("/healthz, /readyz and /metrics require a client certificate; set MONITORING_PORT to serve them to probes")
+	}
+
+	if hsts != "" {
+		handler = withHSTS(handler, hsts)
+		log.Printf("Strict-Transport-Security: %s", hsts)
+	}
+
+	// optionally redirect plaintext HTTP requests to HTTPS
+	if httpPort := os.Getenv("HTTP_PORT"); httpPort != "" {
+		redirectPort := port
+		if fromEnv := os.Getenv("HTTPS_REDIRECT_PORT"); fromEnv != "" {
+			redirectPort = fromEnv
+		}
+		exempt := []string{"/healthz", "/readyz"}
+		if fromEnv, ok := os.LookupEnv("HTTP_REDIRECT_EXEMPT_PATHS"); ok {
+			exempt = splitList(fromEnv)
+		}
+		go func() {
+			log.Printf("Redirecting HTTP requests on port %s to HTTPS port %s", httpPort, redirectPort)
+			log.Fatal(http.ListenAndServe(":"+httpPort, redirectToHTTPS(redirectPort, exempt, server)))
+		}()
+	}
+
+	srv := &http.Server{
+		Addr:      ":" + port,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	policy.apply(srv)
+	log.Printf("TLS policy: %s", policy)
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if boolEnv("PROXY_PROTOCOL") {
+		allowed, err := parsePrefixes(os.Getenv("PROXY_PROTOCOL_ALLOWED_CIDRS"))
+		if err != nil {
+			log.Fatalf("invalid PROXY_PROTOCOL_ALLOWED_CIDRS: %v", err)
+		}
+		// any client could otherwise claim any address
+		if len(allowed) == 0 {
+			log.Fatal("PROXY_PROTOCOL_ALLOWED_CIDRS must be set when PROXY_PROTOCOL is enabled")
+		}
+		ln = withProxyProtocol(ln, allowed)
+		srv.ConnContext = withProxyConn
+		log.Printf("Accepting PROXY protocol headers from %v", allowed)
+	}
 	log.Printf("Server listening on port %s", port)
-	err := http.ListenAndServeTLS(":"+port, tlsCert, tlsKey, server)
+	err = srv.ServeTLS(ln, "", "")
 	log.Fatal(err)
 }
 
-// hello responds to the request with a plain-text "Hello, world" message.
-func hello(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Serving request: %s", r.URL.Path)
-	host, _ := os.Hostname()
-	fmt.Fprintf(w, "Hello, world!\n")
-	fmt.Fprintf(w, "Protocol: %s!\n", r.Proto)
-	fmt.Fprintf(w, "Hostname: %s\n", host)
-	if headerIP := r.Header.Get("X-Forwarded-For"); headerIP != "" {
-		fmt.Fprintf(w, "Client IP (X-Forwarded-For): %s\n", headerIP)
+// boolEnv returns the value of the boolean environment variable name, or
+// false if it is unset, and exits if it is not a valid boolean.
+func boolEnv(name string) bool {
+	fromEnv := os.Getenv(name)
+	if fromEnv == "" {
+		return false
+	}
+	v, err := strconv.ParseBool(fromEnv)
+	if err != nil {
+		log.Fatalf("%s must be a boolean, got %q", name, fromEnv)
+	}
+	return v
+}
+
+// hello returns a handler that responds to the request with a plain-text
+// "Hello, world" message. The client IP is resolved with proxies.
+func hello(proxies *proxyResolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Serving request: %s", r.URL.Path)
+		host, _ := os.Hostname()
+		fmt.Fprintf(w, "Hello, world!\n")
+		fmt.Fprintf(w, "Protocol: %s!\n", r.Proto)
+		fmt.Fprintf(w, "Hostname: %s\n", host)
+		if version, proxy, ok := proxyHeader(r); ok {
+			fmt.Fprintf(w, "PROXY protocol v%d from: %s\n", version, proxy)
+		}
+		client := proxies.resolve(r)
+		fmt.Fprintf(w, "Client IP: %s\n", client.IP)
+		if client.Source != "" {
+			fmt.Fprintf(w, "Client IP chain (%s): %s\n", client.Source, strings.Join(client.Chain, ", "))
+		}
+		if len(client.Trusted) > 0 {
+			fmt.Fprintf(w, "Trusted proxies: %s\n", strings.Join(client.Trusted, ", "))
+		}
+		if r.TLS != nil {
+			fmt.Fprintf(w, "TLS version: %s\n", tls.VersionName(r.TLS.Version))
+			fmt.Fprintf(w, "TLS cipher suite: %s\n", tls.CipherSuiteName(r.TLS.CipherSuite))
+			if r.TLS.NegotiatedProtocol != "" {
+				fmt.Fprintf(w, "TLS ALPN protocol: %s\n", r.TLS.NegotiatedProtocol)
+			}
+			if r.TLS.ServerName != "" {
+				fmt.Fprintf(w, "TLS server name (SNI): %s\n", r.TLS.ServerName)
+			}
+		}
+		if cert := peerCert(r); cert != nil {
+			fmt.Fprintf(w, "Client certificate subject: %s\n", cert.Subject)
+			fmt.Fprintf(w, "Client certificate verified: %t\n", cert.Verified)
+			if len(cert.SANs) > 0 {
+				fmt.Fprintf(w, "Client certificate SANs: %s\n", strings.Join(cert.SANs, ", "))
+			}
+			if cert.SPIFFEID != "" {
+				fmt.Fprintf(w, "Client SPIFFE ID: %s\n", cert.SPIFFEID)
+			}
+		}
 	}
 }
@@ -0,0 +1,94 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	reg = prometheus.NewRegistry()
+
+	certReloads = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hello_app_tls_certificate_reloads_total",
+			Help: "Total number of certificate reload attempts by result (loaded, unchanged or failed).",
+		},
+		[]string{"result"},
+	)
+	ocspFetches = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hello_app_tls_ocsp_fetches_total",
+			Help: "Total number of OCSP response fetches for stapling by result (success or failed).",
+		},
+		[]string{"result"},
+	)
+	ocspNextUpdate = promauto.With(reg).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hello_app_tls_ocsp_next_update_timestamp_seconds",
+			Help: "NextUpdate time of the stapled OCSP response in seconds since the Unix epoch.",
+		},
+	)
+
+	certNotAfterDesc = prometheus.NewDesc(
+		"hello_app_tls_certificate_not_after_timestamp_seconds",
+		"Expiry time of the served certificate in seconds since the Unix epoch.",
+		[]string{"subject", "serial", "issuer"}, nil,
+	)
+	certExpiryDaysDesc = prometheus.NewDesc(
+		"hello_app_tls_certificate_expiry_days",
+		"Days until the served certificate expires; negative once it has expired.",
+		[]string{"subject", "serial", "issuer"}, nil,
+	)
+)
+
+func init() {
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// metricsHandler serves the metrics in reg in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
+}
+
+// certCollector reports the expiry of the certificate currently served by a
+// certLoader. It is computed on every scrape so that the days until expiry
+// stay accurate between reloads.
+type certCollector struct {
+	certs *certLoader
+}
+
+func (c certCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certNotAfterDesc
+	ch <- certExpiryDaysDesc
+}
+
+func (c certCollector) Collect(ch chan<- prometheus.Metric) {
+	leaf := c.certs.cert.Load().Leaf
+	labels := []string{leaf.Subject.String(), serialHex(leaf.SerialNumber), leaf.Issuer.String()}
+	ch <- prometheus.MustNewConstMetric(certNotAfterDesc, prometheus.GaugeValue,
+		float64(leaf.NotAfter.Unix()), labels...)
+	ch <- prometheus.MustNewConstMetric(certExpiryDaysDesc, prometheus.GaugeValue,
+		time.Until(leaf.NotAfter).Hours()/24, labels...)
+}
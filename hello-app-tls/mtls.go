@@ -0,0 +1,94 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// clientAuthModes maps the values of TLS_CLIENT_AUTH to the handshake
+// setting. "require" verifies certificates during the handshake only if one
+// is given, so that requireClientCert can reject requests without a
+// certificate with an HTTP error rather than a TLS alert.
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"verify-if-given": tls.VerifyClientCertIfGiven,
+	"require":         tls.VerifyClientCertIfGiven,
+}
+
+// loadCertPool reads a PEM bundle of trusted CA certificates, such as those
+// trusted to sign client certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// requireClientCert wraps h so that requests without a verified client
+// certificate are rejected.
+func requireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "401 - A client certificate signed by a CA in TLS_CLIENT_CA is required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientCert describes the certificate a client presented.
+type clientCert struct {
+	Subject  string
+	SANs     []string
+	SPIFFEID string
+	Verified bool
+}
+
+// peerCert returns the certificate the client presented on the connection of
+// r, or nil if there is none.
+func peerCert(r *http.Request) *clientCert {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	c := &clientCert{
+		Subject:  cert.Subject.String(),
+		Verified: len(r.TLS.VerifiedChains) > 0,
+	}
+	c.SANs = append(c.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		c.SANs = append(c.SANs, ip.String())
+	}
+	c.SANs = append(c.SANs, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		c.SANs = append(c.SANs, u.String())
+		if strings.EqualFold(u.Scheme, "spiffe") && c.SPIFFEID == "" {
+			c.SPIFFEID = u.String()
+		}
+	}
+	return c
+}
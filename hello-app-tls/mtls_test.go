@@ -0,0 +1,164 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// clientCert returns a client certificate signed by ca with the given SANs.
+func (ca *testCA) clientCert(t *testing.T, dnsNames []string, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "test-client"},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startMTLSServer starts a TLS server with TLS_CLIENT_AUTH mode and client
+// certificates trusted from clientCAs. Its handler reports peerCert as JSON.
+func startMTLSServer(t *testing.T, mode string, clientCAs *x509.CertPool) *httptest.Server {
+	t.Helper()
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(peerCert(r))
+	})
+	if mode == "require" {
+		h = requireClientCert(h)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	// rejected handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: clientAuthModes[mode]}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// getWithCert requests / from srv, presenting certs to it.
+func getWithCert(srv *httptest.Server, certs ...tls.Certificate) (*http.Response, *clientCert, error) {
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.Certificates = certs
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	var c *clientCert
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			return nil, nil, err
+		}
+	}
+	return resp, c, nil
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	srv := startMTLSServer(t, "require", ca.pool())
+
+	resp, _, err := getWithCert(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a client certificate: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	cert := ca.clientCert(t, []string{"client.example.com"}, "spiffe://example.org/ns/default/sa/client", "https://example.org/client")
+	resp, c, err := getWithCert(srv, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("with a trusted client certificate: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !c.Verified || c.Subject != "CN=test-client" {
+		t.Errorf("client certificate = %+v, want verified CN=test-client", c)
+	}
+	wantSANs := []string{"client.example.com", "10.0.0.1", "spiffe://example.org/ns/default/sa/client", "https://example.org/client"}
+	if !slices.Equal(c.SANs, wantSANs) {
+		t.Errorf("SANs = %q, want %q", c.SANs, wantSANs)
+	}
+	if c.SPIFFEID != "spiffe://example.org/ns/default/sa/client" {
+		t.Errorf("SPIFFE ID = %q, want spiffe://example.org/ns/default/sa/client", c.SPIFFEID)
+	}
+}
+
+func TestVerifyIfGivenClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	srv := startMTLSServer(t, "verify-if-given", ca.pool())
+
+	// the handshake fails for a certificate from another CA
+	untrusted := newTestCA(t).clientCert(t, []string{"client.example.com"})
+	if resp, _, err := getWithCert(srv, untrusted); err == nil {
+		t.Errorf("with an untrusted client certificate: status = %d, want a handshake error", resp.StatusCode)
+	}
+
+	// certificates are optional in this mode
+	resp, c, err := getWithCert(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || c != nil {
+		t.Errorf("without a client certificate: status = %d, certificate %+v, want 200 and none", resp.StatusCode, c)
+	}
+
+	resp, c, err = getWithCert(srv, ca.clientCert(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || c == nil || !c.Verified {
+		t.Errorf("with a trusted client certificate: status = %d, certificate %+v, want 200 and verified", resp.StatusCode, c)
+	}
+}
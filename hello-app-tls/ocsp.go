@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspFetchTimeout bounds a single request to the OCSP responder.
+	ocspFetchTimeout = 10 * time.Second
+	// ocspDefaultValidity is how long a response without NextUpdate is
+	// cached for.
+	ocspDefaultValidity = time.Hour
+)
+
+// ocspStapler staples OCSP responses for the certificate served by a
+// certLoader. Responses are fetched from the certificate's OCSP responder,
+// or from responderURL if set, and cached until their NextUpdate. If a fetch
+// fails, the certificate is served without a staple and the error is logged
+// and counted; the server keeps running.
+type ocspStapler struct {
+	certs        *certLoader
+	roots        *x509.CertPool
+	responderURL string
+	client       *http.Client
+
+	staple atomic.Pointer[ocspStaple]
+}
+
+// ocspStaple is a certificate with a stapled OCSP response.
+type ocspStaple struct {
+	// base is the certificate the response was fetched for, and stapled a
+	// copy of it with the response attached.
+	base, stapled *tls.Certificate
+	nextUpdate    time.Time
+}
+
+func newOCSPStapler(certs *certLoader, roots *x509.CertPool, responderURL string) *ocspStapler {
+	return &ocspStapler{
+		certs:        certs,
+		roots:        roots,
+		responderURL: responderURL,
+		client:       &http.Client{Timeout: ocspFetchTimeout},
+	}
+}
+
+// GetCertificate returns the current certificate with its OCSP response
+// stapled, if a response for it is cached and still valid. It is meant to be
+// used as tls.Config.GetCertificate.
+func (s *ocspStapler) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.certs.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	if st := s.staple.Load(); st != nil && st.base == cert && time.Now().Before(st.nextUpdate) {
+		return st.stapled, nil
+	}
+	return cert, nil
+}
+
+// run checks the staple every interval and refreshes it when the certificate
+// changed or the cached response reaches its NextUpdate before the next
+// check.
+func (s *ocspStapler) run(interval time.Duration) {
+	s.refresh(interval)
+	for range time.Tick(interval) {
+		s.refresh(interval)
+	}
+}
+
+func (s *ocspStapler) refresh(margin time.Duration) {
+	cert := s.certs.cert.Load()
+	if st := s.staple.Load(); st != nil && st.base == cert && time.Until(st.nextUpdate) > margin {
+		return
+	}
+	resp, der, err := s.fetch(cert)
+	if err != nil {
+		ocspFetches.WithLabelValues("failed").Inc()
+		log.Printf("Failed to staple OCSP response for certificate %q, serving it without one: %v", cert.Leaf.Subject, err)
+		return
+	}
+	ocspFetches.WithLabelValues("success").Inc()
+
+	nextUpdate := resp.NextUpdate
+	if nextUpdate.IsZero() {
+		nextUpdate = time.Now().Add(ocspDefaultValidity)
+	}
+	stapled := *cert
+	stapled.OCSPStaple = der
+	s.staple.Store(&ocspStaple{base: cert, stapled: &stapled, nextUpdate: nextUpdate})
+	ocspNextUpdate.Set(float64(nextUpdate.Unix()))
+	if resp.Status == ocsp.Revoked {
+		log.Printf("OCSP responder reports certificate %q as revoked at %s", cert.Leaf.Subject, resp.RevokedAt.Format(time.RFC3339))
+	}
+	log.Printf("Stapled OCSP response for certificate %q with status %s, valid until %s",
+		cert.Leaf.Subject, ocspStatus(resp.Status), nextUpdate.Format(time.RFC3339))
+}
+
+// fetch requests the OCSP status of cert from its responder and verifies the
+// response.
+func (s *ocspStapler) fetch(cert *tls.Certificate) (*ocsp.Response, []byte, error) {
+	issuer, err := s.issuer(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	url := s.responderURL
+	if url == "" {
+		if len(cert.Leaf.OCSPServer) == 0 {
+			return nil, nil, errors.New("certificate has no OCSP responder URL")
+		}
+		url = cert.Leaf.OCSPServer[0]
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ocspFetchTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	httpResp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder %s returned %s", url, httpResp.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(der, cert.Leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response from %s: %v", url, err)
+	}
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return nil, nil, fmt.Errorf("OCSP response from %s expired at %s", url, resp.NextUpdate.Format(time.RFC3339))
+	}
+	return resp, der, nil
+}
+
+// issuer returns the certificate that issued the leaf of cert: the next
+// certificate in the chain or, if the chain holds only the leaf, the issuer
+// found by verifying it against the root pool.
+func (s *ocspStapler) issuer(cert *tls.Certificate) (*x509.Certificate, error) {
+	if len(cert.Certificate) > 1 {
+		return x509.ParseCertificate(cert.Certificate[1])
+	}
+	if s.roots != nil {
+		chains, err := verifyChain(cert, s.roots)
+		if err != nil {
+			return nil, err
+		}
+		if len(chains[0]) > 1 {
+			return chains[0][1], nil
+		}
+	}
+	return nil, errors.New("issuer certificate not found; include it in the chain or set TLS_ROOT_CA")
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
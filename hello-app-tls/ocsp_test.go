@@ -0,0 +1,221 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder answers OCSP requests with responses signed by ca, with the
+// configured status and a NextUpdate of nextUpdate from now, or with 500
+// Internal Server Error if fail is set.
+type ocspResponder struct {
+	ca *testCA
+
+	mu         sync.Mutex
+	status     int
+	nextUpdate time.Duration
+	fail       bool
+	requests   int
+}
+
+func (o *ocspResponder) set(status int, nextUpdate time.Duration, fail bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.status, o.nextUpdate, o.fail = status, nextUpdate, fail
+}
+
+func (o *ocspResponder) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requests
+}
+
+func (o *ocspResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests++
+	if o.fail {
+		http.Error(w, "responder unavailable", http.StatusInternalServerError)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	tmpl := ocsp.Response{
+		Status:       o.status,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now.Add(-time.Hour),
+		NextUpdate:   now.Add(o.nextUpdate),
+	}
+	if o.status == ocsp.Revoked {
+		tmpl.RevokedAt = now.Add(-time.Minute)
+		tmpl.RevocationReason = ocsp.KeyCompromise
+	}
+	der, err := ocsp.CreateResponse(o.ca.cert, o.ca.cert, tmpl, o.ca.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(der)
+}
+
+// stapledStatus returns the status of the OCSP response stapled to cert, or
+// -1 if it has none.
+func stapledStatus(t *testing.T, cert *tls.Certificate, ca *testCA) int {
+	t.Helper()
+	if cert.OCSPStaple == nil {
+		return -1
+	}
+	resp, err := ocsp.ParseResponseForCert(cert.OCSPStaple, cert.Leaf, ca.cert)
+	if err != nil {
+		t.Fatalf("stapled response: %v", err)
+	}
+	return resp.Status
+}
+
+func TestOCSPStapler(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	certPEM, keyPEM := ca.issue(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	certs, err := newCertLoader(certFile, keyFile, "", ca.pool())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder := &ocspResponder{ca: ca}
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+	// the leaf holds no issuer, so it is found in the roots
+	s := newOCSPStapler(certs, ca.pool(), srv.URL)
+	served := func() *tls.Certificate {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	failed := func() float64 { return testutil.ToFloat64(ocspFetches.WithLabelValues("failed")) }
+
+	// a good response is stapled and cached until close to its NextUpdate
+	responder.set(ocsp.Good, time.Hour, false)
+	s.refresh(time.Minute)
+	if got := stapledStatus(t, served(), ca); got != ocsp.Good {
+		t.Fatalf("stapled status = %d, want good (%d)", got, ocsp.Good)
+	}
+	nextUpdate := s.staple.Load().nextUpdate
+	if got := testutil.ToFloat64(ocspNextUpdate); got != float64(nextUpdate.Unix()) {
+		t.Errorf("next update metric = %v, want %d", got, nextUpdate.Unix())
+	}
+	s.refresh(time.Minute)
+	if n := responder.count(); n != 1 {
+		t.Errorf("responder was asked %d times, want 1 while the response is fresh", n)
+	}
+
+	// within the margin of NextUpdate, the response is fetched again; if that
+	// fails, the cached response is served until its NextUpdate
+	before := failed()
+	responder.set(ocsp.Good, time.Hour, true)
+	s.refresh(2 * time.Hour)
+	if n := responder.count(); n != 2 {
+		t.Errorf("responder was asked %d times, want 2 once NextUpdate is within the margin", n)
+	}
+	if got := failed() - before; got != 1 {
+		t.Errorf("failed fetches = %v, want 1", got)
+	}
+	if got := stapledStatus(t, served(), ca); got != ocsp.Good {
+		t.Errorf("stapled status after a failed fetch = %d, want the cached good response", got)
+	}
+
+	// a revoked response is stapled as well, so clients see the revocation
+	responder.set(ocsp.Revoked, time.Hour, false)
+	s.refresh(2 * time.Hour)
+	if got := stapledStatus(t, served(), ca); got != ocsp.Revoked {
+		t.Errorf("stapled status = %d, want revoked (%d)", got, ocsp.Revoked)
+	}
+
+	// a rotated certificate is served without a staple until one is fetched
+	// for it, and an expired response is not stapled
+	certPEM, keyPEM = ca.issue(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	if _, err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := stapledStatus(t, served(), ca); got != -1 {
+		t.Errorf("rotated certificate has a staple with status %d, want none", got)
+	}
+	before = failed()
+	responder.set(ocsp.Good, -time.Minute, false)
+	s.refresh(time.Minute)
+	if got := failed() - before; got != 1 {
+		t.Errorf("failed fetches for an expired response = %v, want 1", got)
+	}
+	if got := stapledStatus(t, served(), ca); got != -1 {
+		t.Errorf("expired response was stapled with status %d, want none", got)
+	}
+	if got := served().Leaf.SerialNumber.Int64(); got != 2 {
+		t.Errorf("served serial = %d, want 2", got)
+	}
+}
+
+func TestOCSPStaplerWithoutResponder(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	certPEM, keyPEM := ca.issue(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	writeKeyPair(t, certFile, keyFile, certPEM, keyPEM)
+	certs, err := newCertLoader(certFile, keyFile, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without the issuer, or a responder, the certificate is served as is
+	s := newOCSPStapler(certs, nil, "")
+	before := testutil.ToFloat64(ocspFetches.WithLabelValues("failed"))
+	s.refresh(time.Minute)
+	if got := testutil.ToFloat64(ocspFetches.WithLabelValues("failed")) - before; got != 1 {
+		t.Errorf("failed fetches = %v, want 1", got)
+	}
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert != certs.cert.Load() || cert.OCSPStaple != nil {
+		t.Error("GetCertificate did not return the loaded certificate without a staple")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// tlsPolicy holds the TLS settings that can be configured. Zero values leave
+// Go's defaults in place.
+type tlsPolicy struct {
+	MinVersion, MaxVersion uint16
+	CipherSuites           []uint16
+	CurvePreferences       []tls.CurveID
+	NextProtos             []string
+}
+
+// parseTLSPolicy parses TLS versions such as "1.2", comma-separated cipher
+// suite names as in crypto/tls, curve names (X25519, P-256, P-384, P-521) and
+// ALPN protocol IDs.
+func parseTLSPolicy(minVersion, maxVersion, ciphers, curves, alpn string) (*tlsPolicy, error) {
+	p := &tlsPolicy{}
+	var ok bool
+	if minVersion != "" {
+		if p.MinVersion, ok = tlsVersions[minVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+	}
+	if maxVersion != "" {
+		if p.MaxVersion, ok = tlsVersions[maxVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", maxVersion)
+		}
+	}
+	if p.MinVersion != 0 && p.MaxVersion != 0 && p.MinVersion > p.MaxVersion {
+		return nil, fmt.Errorf("minimum TLS version %s is above maximum %s", minVersion, maxVersion)
+	}
+
+	suites := map[string]*tls.CipherSuite{}
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s
+	}
+	for _, name := range splitList(ciphers) {
+		s, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		// Go ignores TLS 1.3 suites in tls.Config.CipherSuites
+		if !slices.ContainsFunc(s.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return nil, fmt.Errorf("cipher suite %q is a TLS 1.3 suite, which is not configurable; list only TLS 1.0-1.2 suites", name)
+		}
+		p.CipherSuites = append(p.CipherSuites, s.ID)
+	}
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q, must be one of X25519, P-256, P-384 or P-521", name)
+		}
+		p.CurvePreferences = append(p.CurvePreferences, id)
+	}
+	p.NextProtos = splitList(alpn)
+	return p, nil
+}
+
+// apply sets the policy on the server's TLS config. HTTP/2 is disabled if
+// ALPN protocols are configured without "h2"; net/http always offers
+// "http/1.1".
+func (p *tlsPolicy) apply(srv *http.Server) {
+	c := srv.TLSConfig
+	c.MinVersion = p.MinVersion
+	c.MaxVersion = p.MaxVersion
+	c.CipherSuites = p.CipherSuites
+	c.CurvePreferences = p.CurvePreferences
+	if len(p.NextProtos) > 0 {
+		c.NextProtos = p.NextProtos
+		if !slices.Contains(p.NextProtos, "h2") {
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+}
+
+func (p *tlsPolicy) String() string {
+	version := func(v uint16, def string) string {
+		if v == 0 {
+			return def
+		}
+		return tls.VersionName(v)
+	}
+	var suites, curves []string
+	for _, id := range p.CipherSuites {
+		suites = append(suites, tls.CipherSuiteName(id))
+	}
+	for _, id := range p.CurvePreferences {
+		for name, c := range tlsCurves {
+			if c == id {
+				curves = append(curves, name)
+			}
+		}
+	}
+	alpn := p.NextProtos
+	if len(alpn) == 0 {
+		alpn = []string{"h2", "http/1.1"}
+	}
+	return fmt.Sprintf("min version %s, max version %s, cipher suites %s, curves %s, ALPN %s",
+		version(p.MinVersion, "default"), version(p.MaxVersion, "default"),
+		listOrDefault(suites), listOrDefault(curves), strings.Join(alpn, ","))
+}
+
+func listOrDefault(l []string) string {
+	if len(l) == 0 {
+		return "default"
+	}
+	return strings.Join(l, ",")
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var l []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			l = append(l, item)
+		}
+	}
+	return l
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSPolicyCipherSuites(t *testing.T) {
+	p, err := parseTLSPolicy("", "", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	if !slices.Equal(p.CipherSuites, want) {
+		t.Errorf("cipher suites = %v, want %v", p.CipherSuites, want)
+	}
+
+	for _, tc := range []struct {
+		ciphers, want string
+	}{
+		{"TLS_AES_128_GCM_SHA256", "is a TLS 1.3 suite"},
+		{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_CHACHA20_POLY1305_SHA256", "is a TLS 1.3 suite"},
+		{"TLS_NOT_A_SUITE", "unknown cipher suite"},
+	} {
+		if _, err := parseTLSPolicy("", "", tc.ciphers, "", ""); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseTLSPolicy(ciphers %q) = %v, want an error containing %q", tc.ciphers, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// withProxyProtocol wraps ln so that connections may start with a PROXY
+// protocol v1 or v2 header, as sent by TCP and SSL proxy load balancers,
+// before the TLS handshake. The address in the header is then reported as the
+// connection's remote address. Only connections from the allowed prefixes
+// may send a header; connections from elsewhere that do are closed, so if
+// allowed is empty, no source may send a header.
+func withProxyProtocol(ln net.Listener, allowed []netip.Prefix) net.Listener {
+	return &proxyproto.Listener{
+		Listener:          ln,
+		ReadHeaderTimeout: proxyHeaderTimeout,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			addr, err := netip.ParseAddrPort(opts.Upstream.String())
+			if err != nil || !containsAddr(allowed, addr.Addr()) {
+				return proxyproto.REJECT, nil
+			}
+			return proxyproto.USE, nil
+		},
+	}
+}
+
+type proxyConnKey struct{}
+
+// withProxyConn is used as http.Server.ConnContext to make PROXY protocol
+// connections available to handlers through proxyHeader.
+func withProxyConn(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*proxyproto.Conn); ok {
+		return context.WithValue(ctx, proxyConnKey{}, pc)
+	}
+	return ctx
+}
+
+// proxyHeader returns the PROXY protocol version and the address of the proxy
+// the request was received from, or false if the connection did not start
+// with a PROXY protocol header.
+func proxyHeader(r *http.Request) (version byte, proxy net.Addr, ok bool) {
+	pc, ok := r.Context().Value(proxyConnKey{}).(*proxyproto.Conn)
+	if !ok || pc.ProxyHeader() == nil {
+		return 0, nil, false
+	}
+	return pc.ProxyHeader().Version, pc.Raw().RemoteAddr(), true
+}
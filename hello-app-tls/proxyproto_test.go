@@ -0,0 +1,104 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestWithProxyProtocol(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4711}
+	for _, tc := range []struct {
+		name       string
+		allowed    string
+		version    byte // 0 for no header
+		wantRemote string
+		wantErr    bool
+	}{
+		{name: "v1 from allowed peer", allowed: "127.0.0.0/8", version: 1, wantRemote: "198.51.100.1"},
+		{name: "v2 from allowed peer", allowed: "127.0.0.0/8", version: 2, wantRemote: "198.51.100.1"},
+		{name: "no header from allowed peer", allowed: "127.0.0.0/8", wantRemote: "127.0.0.1"},
+		{name: "v1 from disallowed peer", allowed: "192.0.2.0/24", version: 1, wantErr: true},
+		{name: "v2 from disallowed peer", allowed: "192.0.2.0/24", version: 2, wantErr: true},
+		{name: "no header from disallowed peer", allowed: "192.0.2.0/24", wantRemote: "127.0.0.1"},
+		{name: "v2 with no allowed peers", allowed: "", version: 2, wantErr: true},
+	} {
+		allowed, err := parsePrefixes(tc.allowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pln := withProxyProtocol(ln, allowed)
+
+		type result struct {
+			remote, line string
+			err          error
+		}
+		done := make(chan result, 1)
+		go func() {
+			conn, err := pln.Accept()
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			done <- result{remote: conn.RemoteAddr().String(), line: line, err: err}
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.version != 0 {
+			header := proxyproto.HeaderProxyFromAddrs(tc.version, client, conn.RemoteAddr())
+			if _, err := header.WriteTo(conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := conn.Write([]byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		conn.Close()
+		pln.Close()
+
+		if tc.wantErr {
+			if res.err == nil {
+				t.Errorf("%s: read %q from %s, want the connection rejected", tc.name, res.line, res.remote)
+			}
+			continue
+		}
+		if res.err != nil {
+			t.Errorf("%s: %v", tc.name, res.err)
+			continue
+		}
+		if res.line != "hello\n" {
+			t.Errorf("%s: read %q, want %q", tc.name, res.line, "hello\n")
+		}
+		if host, _, _ := net.SplitHostPort(res.remote); host != tc.wantRemote {
+			t.Errorf("%s: remote address = %s, want host %s", tc.name, res.remote, tc.wantRemote)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, tc := range []struct {
+		port, host, target, want string
+	}{
+		{"8443", "example.com", "/a?b=c", "https://example.com:8443/a?b=c"},
+		{"8443", "example.com:8080", "/", "https://example.com:8443/"},
+		{"443", "example.com:8080", "/a", "https://example.com/a"},
+		{"443", "example.com", "/a", "https://example.com/a"},
+		{"8443", "[2001:db8::1]:8080", "/a", "https://[2001:db8::1]:8443/a"},
+		{"8443", "[2001:db8::1]", "/a", "https://[2001:db8::1]:8443/a"},
+		{"443", "[2001:db8::1]:8080", "/a", "https://[2001:db8::1]/a"},
+		{"443", "[2001:db8::1]", "/a", "https://[2001:db8::1]/a"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		redirectToHTTPS(tc.port, []string{"/healthz"}, next).ServeHTTP(rec, req)
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("port %s, host %s: status = %d, want %d", tc.port, tc.host, rec.Code, http.StatusPermanentRedirect)
+		}
+		if got := rec.Header().Get("Location"); got != tc.want {
+			t.Errorf("port %s, host %s: Location = %q, want %q", tc.port, tc.host, got, tc.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	redirectToHTTPS("8443", []string{"/healthz"}, next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("exempt path: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+}
+
+func TestWithHSTS(t *testing.T) {
+	hsts := hstsHeader(365*24*time.Hour, true, true)
+	if want := "max-age=31536000; includeSubDomains; preload"; hsts != want {
+		t.Errorf("hstsHeader = %q, want %q", hsts, want)
+	}
+	h := withHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), hsts)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("plaintext response has Strict-Transport-Security %q, want none", got)
+	}
+
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Strict-Transport-Security"); got != hsts {
+		t.Errorf("TLS response has Strict-Transport-Security %q, want %q", got, hsts)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long generated certificates are valid for.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// defaultSANs returns the names a generated certificate is valid for when
+// none are configured: the hostname, the Pod IP and localhost.
+func defaultSANs() []string {
+	var sans []string
+	if hostname, err := os.Hostname(); err == nil {
+		sans = append(sans, hostname)
+	}
+	if podIP := os.Getenv("POD_IP"); podIP != "" {
+		sans = append(sans, podIP)
+	}
+	return append(sans, "localhost", "127.0.0.1", "::1")
+}
+
+// newSelfSignedLoader generates an in-memory CA and a certificate for sans
+// signed by it. IP addresses in sans become IP SANs, and everything else DNS
+// SANs. If caFile is not empty, the CA certificate is written to it in PEM
+// format so that clients can trust it. The certificate is never reloaded.
+func newSelfSignedLoader(sans []string, caFile string) (*certLoader, error) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "hello-app-tls self-signed CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	if caTemplate.SerialNumber, err = serialNumber(); err != nil {
+		return nil, err
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: sans[0]},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(selfSignedValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.SerialNumber, err = serialNumber(); err != nil {
+		return nil, err
+	}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if caFile != "" {
+		caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+		if err := os.WriteFile(caFile, caPEM, 0o644); err != nil {
+			return nil, err
+		}
+		log.Printf("Wrote self-signed CA certificate to %s", caFile)
+	}
+	log.Printf("Generated self-signed certificate for %v, valid until %s", sans, leaf.NotAfter.Format(time.RFC3339))
+	log.Printf("Certificate SHA-256 fingerprint: %s", fingerprint(der))
+	log.Printf("CA certificate SHA-256 fingerprint: %s", fingerprint(caDER))
+
+	l := &certLoader{}
+	l.cert.Store(&tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	})
+	return l, nil
+}
+
+// serialNumber returns a random 128-bit certificate serial number.
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// fingerprint returns the SHA-256 fingerprint of a DER certificate in the
+// colon-separated form printed by openssl.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	pairs := make([]string, len(sum))
+	for i, b := range sum {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
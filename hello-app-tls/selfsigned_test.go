@@ -0,0 +1,73 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestNewSelfSignedLoader(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	l, err := newSelfSignedLoader([]string{"localhost", "127.0.0.1", "hello.example.com", "::1"}, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := l.cert.Load().Leaf
+	if want := []string{"localhost", "hello.example.com"}; !slices.Equal(leaf.DNSNames, want) {
+		t.Errorf("DNS SANs = %q, want %q", leaf.DNSNames, want)
+	}
+	var ips []string
+	for _, ip := range leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	if want := []string{"127.0.0.1", "::1"}; !slices.Equal(ips, want) {
+		t.Errorf("IP SANs = %q, want %q", ips, want)
+	}
+	if leaf.Subject.CommonName != "localhost" {
+		t.Errorf("subject CN = %q, want the first SAN localhost", leaf.Subject.CommonName)
+	}
+
+	// the CA file holds a single PEM certificate that the leaf verifies against
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(caPEM)
+	if block == nil || block.Type != "CERTIFICATE" || len(rest) != 0 {
+		t.Fatalf("CA file is not a single PEM CERTIFICATE block: %q", caPEM)
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.IsCA {
+		t.Error("CA certificate is not a CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, name := range []string{"localhost", "127.0.0.1", "hello.example.com", "::1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("verifying the certificate for %s: %v", name, err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "other.example.com", Roots: roots}); err == nil {
+		t.Error("certificate verified for other.example.com, want an error")
+	}
+}
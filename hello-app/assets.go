@@ -0,0 +1,112 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// embedded holds the default landing page template and static files.
+//
+//go:embed static templates
+var embedded embed.FS
+
+// startTime is reported as the modification time of embedded files, which
+// cannot change while the process runs.
+var startTime = time.Now()
+
+// pageTemplate is the path of the landing page template within the assets.
+const pageTemplate = "templates/hello.html"
+
+// newAssets returns the assets served by hello-app. Files in dir, laid out
+// like the embedded static/ and templates/ directories, take precedence over
+// the embedded copies. An empty dir serves only the embedded assets.
+func newAssets(dir string) fs.FS {
+	if dir == "" {
+		return embedded
+	}
+	return overlayFS{upper: os.DirFS(dir), lower: embedded}
+}
+
+// overlayFS serves files from upper, falling back to lower for files that do
+// not exist in upper.
+type overlayFS struct {
+	upper, lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.lower.Open(name)
+	}
+	return f, err
+}
+
+// loadPage parses the landing page template from assets. It is parsed on
+// every request so that changes to a mounted ConfigMap apply without a
+// restart.
+func loadPage(assets fs.FS) (*template.Template, error) {
+	return template.ParseFS(assets, pageTemplate)
+}
+
+// staticHandler serves the files under static/ in assets at /static/. It sets
+// ETag and Last-Modified so browsers and caches can revalidate them.
+func staticHandler(assets fs.FS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "static/" + strings.TrimPrefix(r.URL.Path, "/static/")
+		if !fs.ValidPath(name) {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := assets.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, "failed to read "+name, http.StatusInternalServerError)
+			return
+		}
+
+		modTime := info.ModTime()
+		if modTime.IsZero() {
+			modTime = startTime
+		}
+		sum := sha256.Sum256(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,281 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings of hello-app. Every setting can be given as a
+// command-line flag or as an environment variable; flags take precedence.
+type config struct {
+	Port              string
+	MetricsPort       string
+	GRPCPort          string
+	H2C               bool
+	Message           string
+	AssetsDir         string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxBodyBytes      int64
+	HandlerTimeout    time.Duration
+	LogFormat         string
+	LogLevel          slog.Level
+	LogSampleRate     float64
+	Project           string
+	TraceEndpoint     string
+	TraceSampleRate   float64
+	ShutdownDelay     time.Duration
+	ShutdownGrace     time.Duration
+	MetadataLookup    bool
+	MetadataURL       string
+	Echo              bool
+	Faults            faults
+	FaultMaxMemory    int64
+	FaultQuery        bool
+	FaultAdmin        bool
+	EchoRedact        []string
+}
+
+// loadConfig reads the configuration from the command-line arguments args and
+// from the environment through getenv, and validates it.
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	var c config
+	var errs []error
+	fs := flag.NewFlagSet("hello-app", flag.ContinueOnError)
+
+	str := func(p *string, name, env, def, usage string) {
+		if v := getenv(env); v != "" {
+			def = v
+		}
+		fs.StringVar(p, name, def, usage+" ($"+env+")")
+	}
+	dur := func(p *time.Duration, name, env string, def time.Duration, usage string) {
+		if v := getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %v", env, v, err))
+			}
+			def = d
+		}
+		fs.DurationVar(p, name, def, usage+" ($"+env+")")
+	}
+	num := func(p *int, name, env string, def int, usage string) {
+		if v := getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %v", env, v, err))
+			}
+			def = n
+		}
+		fs.IntVar(p, name, def, usage+" ($"+env+")")
+	}
+	num64 := func(p *int64, name, env string, def int64, usage string) {
+		if v := getenv(env); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %v", env, v, err))
+			}
+			def = n
+		}
+		fs.Int64Var(p, name, def, usage+" ($"+env+")")
+	}
+	boolean := func(p *bool, name, env string, def bool, usage string) {
+		if v := getenv(env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %v", env, v, err))
+			}
+			def = b
+		}
+		fs.BoolVar(p, name, def, usage+" ($"+env+")")
+	}
+	frac := func(p *float64, name, env string, def float64, usage string) {
+		if v := getenv(env); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %v", env, v, err))
+			}
+			def = f
+		}
+		fs.Float64Var(p, name, def, usage+" ($"+env+")")
+	}
+
+	var level, redact string
+	str(&c.Port, "port", "PORT", "8080", "port to serve requests on")
+	str(&c.MetricsPort, "metrics-port", "METRICS_PORT", "", "separate port to serve /metrics on")
+	str(&c.GRPCPort, "grpc-port", "GRPC_PORT", "", "separate port to serve gRPC on")
+	boolean(&c.H2C, "h2c", "H2C", false, "accept HTTP/2 cleartext and gRPC on the main port")
+	str(&c.Message, "message", "MESSAGE", "Hello, world!", "greeting returned by /")
+	str(&c.AssetsDir, "assets-dir", "ASSETS_DIR", "", "directory whose static/ and templates/ files override the embedded ones")
+	dur(&c.ReadHeaderTimeout, "read-header-timeout", "READ_HEADER_TIMEOUT", 5*time.Second, "maximum duration for reading request headers")
+	dur(&c.ReadTimeout, "read-timeout", "READ_TIMEOUT", 10*time.Second, "maximum duration for reading a request")
+	dur(&c.WriteTimeout, "write-timeout", "WRITE_TIMEOUT", 10*time.Second, "maximum duration for writing a response")
+	dur(&c.IdleTimeout, "idle-timeout", "IDLE_TIMEOUT", 60*time.Second, "maximum time to keep an idle connection open")
+	num(&c.MaxHeaderBytes, "max-header-bytes", "MAX_HEADER_BYTES", 1<<20, "maximum size of request headers")
+	num64(&c.MaxBodyBytes, "max-body-bytes", "MAX_BODY_BYTES", 1<<20, "maximum size of request bodies, 0 for no limit")
+	dur(&c.HandlerTimeout, "handler-timeout", "HANDLER_TIMEOUT", 5*time.Second, "maximum duration for handling a request, 0 for no limit")
+	str(&c.LogFormat, "log-format", "LOG_FORMAT", "json", "log format, json or text")
+	str(&level, "log-level", "LOG_LEVEL", "info", "minimum log severity: debug, info, warning or error")
+	frac(&c.LogSampleRate, "log-sample-rate", "LOG_SAMPLE_RATE", 1, "fraction of successful requests to log")
+	str(&c.Project, "project", "GOOGLE_CLOUD_PROJECT", "", "Google Cloud project ID used to link logs to traces")
+	str(&c.TraceEndpoint, "otlp-endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT", "", "OTLP/HTTP endpoint to export spans to, such as http://otel-collector:4318")
+	frac(&c.TraceSampleRate, "trace-sample-rate", "TRACE_SAMPLE_RATE", 1, "fraction of new traces to sample")
+	dur(&c.ShutdownDelay, "shutdown-delay", "SHUTDOWN_DELAY", 0, "time to fail readiness before shutting down")
+	dur(&c.ShutdownGrace, "shutdown-grace-period", "SHUTDOWN_GRACE_PERIOD", 10*time.Second, "time to wait for in-flight requests on shutdown")
+	boolean(&c.MetadataLookup, "metadata-lookup", "METADATA_LOOKUP", false, "look up zone and cluster name on the metadata server")
+	str(&c.MetadataURL, "metadata-url", "METADATA_URL", "http://metadata.google.internal", "address of the metadata server")
+	boolean(&c.Echo, "echo", "ECHO", false, "serve /echo, which returns the request as JSON")
+	str(&redact, "echo-redact-headers", "ECHO_REDACT_HEADERS", "Authorization,Cookie,Proxy-Authorization,X-Api-Key", "comma-separated headers whose values /echo redacts")
+	frac(&c.Faults.ErrorPercent, "fault-error-percent", "FAULT_ERROR_PERCENT", 0, "percentage of requests to / answered with an error")
+	num(&c.Faults.ErrorCode, "fault-error-code", "FAULT_ERROR_CODE", http.StatusInternalServerError, "status code of injected errors")
+	frac(&c.Faults.DropPercent, "fault-drop-percent", "FAULT_DROP_PERCENT", 0, "percentage of requests to / whose connection is dropped")
+	dur((*time.Duration)(&c.Faults.Latency), "fault-latency", "FAULT_LATENCY", 0, "latency added to requests to /")
+	dur((*time.Duration)(&c.Faults.LatencyJitter), "fault-latency-jitter", "FAULT_LATENCY_JITTER", 0, "spread of the added latency")
+	str(&c.Faults.LatencyDistribution, "fault-latency-distribution", "FAULT_LATENCY_DISTRIBUTION", "fixed", "distribution of the added latency: fixed, uniform, normal or exponential")
+	dur((*time.Duration)(&c.Faults.CPU), "fault-cpu", "FAULT_CPU", 0, "CPU time burned by each request to /")
+	num64(&c.Faults.MemoryBytes, "fault-memory-bytes", "FAULT_MEMORY_BYTES", 0, "memory held by each request to /")
+	num64(&c.FaultMaxMemory, "fault-max-memory", "FAULT_MAX_MEMORY", 64<<20, "maximum memory each request to / can be made to hold")
+	boolean(&c.FaultQuery, "fault-query", "FAULT_QUERY", false, "let fault-* query parameters override the fault settings")
+	boolean(&c.FaultAdmin, "fault-admin", "FAULT_ADMIN", false, "serve /admin/faults to read and change the fault settings")
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return c, err
+	}
+
+	for _, h := range strings.Split(redact, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			c.EchoRedact = append(c.EchoRedact, h)
+		}
+	}
+
+	var err error
+	if c.LogLevel, err = parseLevel(level); err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+// validate reports an error for settings that are out of range.
+func (c config) validate() error {
+	var errs []error
+	if n, err := strconv.Atoi(c.Port); err != nil || n < 1 || n > 65535 {
+		errs = append(errs, fmt.Errorf("port %q is not a valid port number", c.Port))
+	}
+	if c.MetricsPort != "" {
+		if n, err := strconv.Atoi(c.MetricsPort); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Errorf("metrics port %q is not a valid port number", c.MetricsPort))
+		}
+	}
+	if c.GRPCPort != "" {
+		if n, err := strconv.Atoi(c.GRPCPort); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Errorf("gRPC port %q is not a valid port number", c.GRPCPort))
+		}
+		if c.GRPCPort == c.Port || c.GRPCPort == c.MetricsPort {
+			errs = append(errs, fmt.Errorf("gRPC port %s must differ from the other ports; set H2C=true to serve gRPC on the main port", c.GRPCPort))
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read header timeout", c.ReadHeaderTimeout},
+		{"read timeout", c.ReadTimeout},
+		{"write timeout", c.WriteTimeout},
+		{"idle timeout", c.IdleTimeout},
+		{"handler timeout", c.HandlerTimeout},
+		{"shutdown delay", c.ShutdownDelay},
+		{"shutdown grace period", c.ShutdownGrace},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", d.name, d.value))
+		}
+	}
+	if c.MaxHeaderBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max header bytes must be positive, got %d", c.MaxHeaderBytes))
+	}
+	if c.MaxBodyBytes < 0 {
+		errs = append(errs, fmt.Errorf("max body bytes must not be negative, got %d", c.MaxBodyBytes))
+	}
+	if c.HandlerTimeout > 0 && c.WriteTimeout > 0 && c.HandlerTimeout >= c.WriteTimeout {
+		errs = append(errs, fmt.Errorf("handler timeout %s must be shorter than write timeout %s", c.HandlerTimeout, c.WriteTimeout))
+	}
+	if c.FaultMaxMemory < 0 {
+		errs = append(errs, fmt.Errorf("fault max memory must not be negative, got %d", c.FaultMaxMemory))
+	} else if err := c.Faults.validate(c.FaultMaxMemory); err != nil {
+		errs = append(errs, err)
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		errs = append(errs, fmt.Errorf("log format must be json or text, got %q", c.LogFormat))
+	}
+	if c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("log sample rate must be between 0 and 1, got %g", c.LogSampleRate))
+	}
+	if c.TraceSampleRate < 0 || c.TraceSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("trace sample rate must be between 0 and 1, got %g", c.TraceSampleRate))
+	}
+	return errors.Join(errs...)
+}
+
+// LogValue implements slog.LogValuer so the effective configuration can be
+// logged at startup.
+func (c config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("port", c.Port),
+		slog.String("metricsPort", c.MetricsPort),
+		slog.String("grpcPort", c.GRPCPort),
+		slog.Bool("h2c", c.H2C),
+		slog.String("message", c.Message),
+		slog.String("assetsDir", c.AssetsDir),
+		slog.String("readHeaderTimeout", c.ReadHeaderTimeout.String()),
+		slog.String("readTimeout", c.ReadTimeout.String()),
+		slog.String("writeTimeout", c.WriteTimeout.String()),
+		slog.String("idleTimeout", c.IdleTimeout.String()),
+		slog.Int("maxHeaderBytes", c.MaxHeaderBytes),
+		slog.Int64("maxBodyBytes", c.MaxBodyBytes),
+		slog.String("handlerTimeout", c.HandlerTimeout.String()),
+		slog.String("logFormat", c.LogFormat),
+		slog.String("logLevel", severity(c.LogLevel)),
+		slog.Float64("logSampleRate", c.LogSampleRate),
+		slog.String("project", c.Project),
+		slog.String("otlpEndpoint", c.TraceEndpoint),
+		slog.Float64("traceSampleRate", c.TraceSampleRate),
+		slog.String("shutdownDelay", c.ShutdownDelay.String()),
+		slog.String("shutdownGracePeriod", c.ShutdownGrace.String()),
+		slog.Bool("metadataLookup", c.MetadataLookup),
+		slog.String("metadataURL", c.MetadataURL),
+		slog.Bool("echo", c.Echo),
+		slog.String("echoRedactHeaders", strings.Join(c.EchoRedact, ",")),
+		slog.Any("faults", c.Faults),
+		slog.Int64("faultMaxMemory", c.FaultMaxMemory),
+		slog.Bool("faultQuery", c.FaultQuery),
+		slog.Bool("faultAdmin", c.FaultAdmin),
+	)
+}
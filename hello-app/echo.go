@@ -0,0 +1,140 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"unicode/utf8"
+)
+
+// redacted replaces the value of sensitive headers in /echo responses.
+const redacted = "REDACTED"
+
+// forwardedHeaders are the headers set by proxies and load balancers that
+// /echo reports separately.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"Via",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+	"X-Cloud-Trace-Context",
+}
+
+// echoRequest is the JSON body returned by /echo.
+type echoRequest struct {
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Proto      string              `json:"proto"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remoteAddr"`
+	Headers    map[string][]string `json:"headers"`
+	Forwarded  map[string][]string `json:"forwarded,omitempty"`
+	TLS        *echoTLS            `json:"tls"`
+	Body       string              `json:"body"`
+	// BodyEncoding is "base64" when the body is not valid UTF-8.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+	BodyError    string `json:"bodyError,omitempty"`
+}
+
+// echoTLS describes the TLS connection a request arrived on.
+type echoTLS struct {
+	Version            string `json:"version"`
+	CipherSuite        string `json:"cipherSuite"`
+	ServerName         string `json:"serverName,omitempty"`
+	NegotiatedProtocol string `json:"negotiatedProtocol,omitempty"`
+	Resumed            bool   `json:"resumed"`
+}
+
+// echo returns a handler that responds with a JSON description of the request
+// as it reached the server. The values of the headers in redact are replaced.
+func echo(redact []string) http.HandlerFunc {
+	sensitive := make(map[string]bool, len(redact))
+	for _, h := range redact {
+		sensitive[http.CanonicalHeaderKey(h)] = true
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := echoRequest{
+			Method:     r.Method,
+			URL:        requestURL(r),
+			Proto:      r.Proto,
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			Headers:    make(map[string][]string, len(r.Header)),
+		}
+		for k, v := range r.Header {
+			if sensitive[k] {
+				v = []string{redacted}
+			}
+			e.Headers[k] = v
+		}
+		for _, k := range forwardedHeaders {
+			if v, ok := e.Headers[k]; ok {
+				if e.Forwarded == nil {
+					e.Forwarded = make(map[string][]string)
+				}
+				e.Forwarded[k] = v
+			}
+		}
+		if r.TLS != nil {
+			e.TLS = &echoTLS{
+				Version:            tls.VersionName(r.TLS.Version),
+				CipherSuite:        tls.CipherSuiteName(r.TLS.CipherSuite),
+				ServerName:         r.TLS.ServerName,
+				NegotiatedProtocol: r.TLS.NegotiatedProtocol,
+				Resumed:            r.TLS.DidResume,
+			}
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			e.BodyError = err.Error()
+		}
+		if utf8.Valid(body) {
+			e.Body = string(body)
+		} else {
+			e.Body = base64.StdEncoding.EncodeToString(body)
+			e.BodyEncoding = "base64"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(e); err != nil {
+			log.Printf("Failed to write echo response: %v", err)
+		}
+	}
+}
+
+// requestURL reconstructs the absolute URL the client requested.
+func requestURL(r *http.Request) string {
+	u := *r.URL
+	u.Host = r.Host
+	u.Scheme = "http"
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
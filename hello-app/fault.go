@@ -0,0 +1,256 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// faults describes the failures injected into requests. The zero value
+// injects nothing.
+type faults struct {
+	// ErrorPercent is the percentage of requests answered with ErrorCode.
+	ErrorPercent float64 `json:"errorPercent"`
+	ErrorCode    int     `json:"errorCode"`
+	// DropPercent is the percentage of requests whose connection is closed
+	// without a response.
+	DropPercent float64 `json:"dropPercent"`
+	// Latency is added to every request, spread by LatencyJitter according to
+	// LatencyDistribution: "fixed", "uniform" (Latency±LatencyJitter),
+	// "normal" (mean Latency, standard deviation LatencyJitter) or
+	// "exponential" (mean Latency).
+	Latency             duration `json:"latency"`
+	LatencyJitter       duration `json:"latencyJitter"`
+	LatencyDistribution string   `json:"latencyDistribution"`
+	// CPU is the CPU time each request spends in a busy loop.
+	CPU duration `json:"cpu"`
+	// MemoryBytes is the memory each request allocates and holds until it
+	// completes.
+	MemoryBytes int64 `json:"memoryBytes"`
+}
+
+// validate reports an error for settings that are out of range, including
+// memory above maxMemory bytes.
+func (f faults) validate(maxMemory int64) error {
+	switch {
+	case f.ErrorPercent < 0 || f.ErrorPercent > 100:
+		return fmt.Errorf("fault error percent must be between 0 and 100, got %g", f.ErrorPercent)
+	case f.ErrorCode < 500 || f.ErrorCode > 599:
+		return fmt.Errorf("fault error code must be a 5xx status, got %d", f.ErrorCode)
+	case f.DropPercent < 0 || f.DropPercent > 100:
+		return fmt.Errorf("fault drop percent must be between 0 and 100, got %g", f.DropPercent)
+	case f.Latency < 0 || f.LatencyJitter < 0 || f.CPU < 0:
+		return fmt.Errorf("fault durations must not be negative")
+	case f.MemoryBytes < 0 || f.MemoryBytes > maxMemory:
+		return fmt.Errorf("fault memory bytes must be between 0 and %d, got %d", maxMemory, f.MemoryBytes)
+	}
+	switch f.LatencyDistribution {
+	case "fixed", "uniform", "normal", "exponential":
+		return nil
+	}
+	return fmt.Errorf("fault latency distribution must be fixed, uniform, normal or exponential, got %q", f.LatencyDistribution)
+}
+
+// delay returns the latency to add to one request.
+func (f faults) delay() time.Duration {
+	mean, jitter := float64(f.Latency), float64(f.LatencyJitter)
+	var d float64
+	switch f.LatencyDistribution {
+	case "uniform":
+		d = mean + (rand.Float64()*2-1)*jitter
+	case "normal":
+		d = mean + rand.NormFloat64()*jitter
+	case "exponential":
+		d = rand.ExpFloat64() * mean
+	default:
+		d = mean
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// withQuery returns a copy of f with the settings overridden by the fault-*
+// query parameters of q, such as ?fault-error=50&fault-latency=200ms. The
+// memory held may not exceed maxMemory bytes.
+func (f faults) withQuery(q url.Values, maxMemory int64) (faults, error) {
+	var err error
+	set := func(name string, parse func(string) error) {
+		if v := q.Get(name); v != "" && err == nil {
+			if perr := parse(v); perr != nil {
+				err = fmt.Errorf("invalid %s %q: %v", name, v, perr)
+			}
+		}
+	}
+	set("fault-error", func(v string) (e error) { f.ErrorPercent, e = strconv.ParseFloat(v, 64); return })
+	set("fault-error-code", func(v string) (e error) { f.ErrorCode, e = strconv.Atoi(v); return })
+	set("fault-drop", func(v string) (e error) { f.DropPercent, e = strconv.ParseFloat(v, 64); return })
+	set("fault-latency", f.Latency.Set)
+	set("fault-latency-jitter", f.LatencyJitter.Set)
+	set("fault-latency-distribution", func(v string) error { f.LatencyDistribution = v; return nil })
+	set("fault-cpu", f.CPU.Set)
+	set("fault-memory", func(v string) (e error) { f.MemoryBytes, e = strconv.ParseInt(v, 10, 64); return })
+	if err != nil {
+		return f, err
+	}
+	return f, f.validate(maxMemory)
+}
+
+// faultInjector injects faults into the requests served by a handler.
+type faultInjector struct {
+	mu     sync.RWMutex
+	faults faults
+	// query allows requests to override the faults with query parameters.
+	query bool
+	// maxMemory caps the memory each request may be made to hold, whether
+	// set through query parameters or /admin/faults.
+	maxMemory int64
+}
+
+// get returns the current faults.
+func (fi *faultInjector) get() faults {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	return fi.faults
+}
+
+// wrap returns a handler that injects the current faults before calling h.
+func (fi *faultInjector) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := fi.get()
+		if fi.query {
+			var err error
+			if f, err = f.withQuery(r.URL.Query(), fi.maxMemory); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if f.MemoryBytes > 0 {
+			buf := make([]byte, f.MemoryBytes)
+			// touch every page so the memory is actually resident
+			for i := 0; i < len(buf); i += os.Getpagesize() {
+				buf[i] = 1
+			}
+			defer runtime.KeepAlive(buf)
+		}
+		if f.CPU > 0 {
+			burnCPU(r.Context(), time.Duration(f.CPU))
+		}
+		if d := f.delay(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.DropPercent > 0 && rand.Float64()*100 < f.DropPercent {
+			// the server closes the connection without writing a response
+			log.Printf("Injected connection drop for %s %s", r.Method, r.URL.Path)
+			faultsInjected.WithLabelValues("drop").Inc()
+			panic(http.ErrAbortHandler)
+		}
+		if f.ErrorPercent > 0 && rand.Float64()*100 < f.ErrorPercent {
+			faultsInjected.WithLabelValues("error").Inc()
+			http.Error(w, fmt.Sprintf("%d - Injected fault", f.ErrorCode), f.ErrorCode)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP serves the fault settings as JSON on GET, and replaces them with
+// the JSON request body on PUT or POST.
+func (fi *faultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		f := fi.get()
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "invalid fault settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.validate(fi.maxMemory); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fi.mu.Lock()
+		fi.faults = f
+		fi.mu.Unlock()
+		log.Printf("Updated fault settings: %+v", f)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(fi.get()); err != nil {
+		log.Printf("Failed to write fault settings: %v", err)
+	}
+}
+
+// burnCPU keeps one CPU busy for d, or until ctx is done.
+func burnCPU(ctx context.Context, d time.Duration) {
+	deadline := time.Now().Add(d)
+	for n := 0; time.Now().Before(deadline); n++ {
+		if n%1000 == 0 && ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// duration is a time.Duration that is written to and read from JSON as a
+// string such as "250ms".
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses s with time.ParseDuration. It implements flag.Value.
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
@@ -0,0 +1,119 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// helloServer implements the hello.v1.Hello service described in hello.proto.
+// It is registered by hand so that the sample builds without generated code:
+// the request is a google.protobuf.Empty and the response a
+// google.protobuf.Struct with the same fields as the JSON hello response.
+type helloServer interface {
+	SayHello(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+}
+
+var helloServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hello.v1.Hello",
+	HandlerType: (*helloServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "SayHello",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(emptypb.Empty)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return srv.(helloServer).SayHello(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/hello.v1.Hello/SayHello"}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(helloServer).SayHello(ctx, req.(*emptypb.Empty))
+			})
+		},
+	}},
+	Metadata: "hello.proto",
+}
+
+// greeter implements helloServer.
+type greeter struct {
+	message string
+	env     environment
+}
+
+func (g greeter) SayHello(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	method, _ := grpc.Method(ctx)
+	b, err := json.Marshal(newGreeting(g.message, g.env, method))
+	if err != nil {
+		return nil, err
+	}
+	s := &structpb.Struct{}
+	return s, protojson.Unmarshal(b, s)
+}
+
+// newGRPCServer returns a gRPC server with the hello.v1.Hello and
+// grpc.health.v1.Health services registered, along with the health server so
+// the caller can report NOT_SERVING on shutdown. SayHello responds with
+// message and details about env.
+func newGRPCServer(message string, env environment) (*grpc.Server, *health.Server) {
+	s := grpc.NewServer()
+	s.RegisterService(&helloServiceDesc, greeter{message: message, env: env})
+	hs := health.NewServer()
+	hs.SetServingStatus(helloServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, hs)
+	return s, hs
+}
+
+// withH2C wraps h so that it accepts HTTP/2 over cleartext connections. If g
+// is not nil, gRPC requests are routed to g and all others to h. gRPC
+// requests are not subject to the server's read and write timeouts, which
+// would otherwise reset streaming RPCs such as health Watch.
+func withH2C(h http.Handler, g *grpc.Server) http.Handler {
+	if g != nil {
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+				rc := http.NewResponseController(w)
+				if err := rc.SetReadDeadline(time.Time{}); err != nil {
+					log.Printf("Failed to clear the read deadline of gRPC request %s: %v", r.URL.Path, err)
+				}
+				if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+					log.Printf("Failed to clear the write deadline of gRPC request %s: %v", r.URL.Path, err)
+				}
+				g.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return h2c.NewHandler(h, &http2.Server{})
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// checkTimeout bounds how long a single readiness check may run.
+const checkTimeout = 2 * time.Second
+
+// readinessCheck reports whether a dependency the server relies on is
+// available. A nil error means the dependency is healthy.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecks is the list of checks run by /readyz. Register additional
+// checks with addReadinessCheck before the server starts.
+var readinessChecks []readinessCheck
+
+// addReadinessCheck registers a dependency check that must pass for the
+// server to report ready.
+func addReadinessCheck(name string, check func(ctx context.Context) error) {
+	readinessChecks = append(readinessChecks, readinessCheck{name: name, check: check})
+}
+
+// checkStatus is the JSON representation of a single check result.
+type checkStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthStatus is the JSON body returned by /healthz and /readyz.
+type healthStatus struct {
+	Status string        `json:"status"`
+	Checks []checkStatus `json:"checks,omitempty"`
+}
+
+// healthz reports that the process is alive. It does not depend on the drain
+// state or on any dependency, so the kubelet only restarts a wedged process.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// readyz reports whether the server should receive traffic. It fails as soon
+// as shutdown begins or when any registered readiness check fails.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	code := http.StatusOK
+	status := healthStatus{Status: "ok"}
+
+	drain := checkStatus{Name: "shutdown", Status: "ok"}
+	if isDraining() {
+		drain.Status = "failed"
+		drain.Error = "server is shutting down"
+		code = http.StatusServiceUnavailable
+	}
+	status.Checks = append(status.Checks, drain)
+
+	for _, c := range readinessChecks {
+		result := checkStatus{Name: c.name, Status: "ok"}
+		if err := c.check(ctx); err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			code = http.StatusServiceUnavailable
+		}
+		status.Checks = append(status.Checks, result)
+	}
+
+	if code != http.StatusOK {
+		status.Status = "unavailable"
+	}
+	writeHealth(w, code, status)
+}
+
+// writeHealth writes status as a JSON response with the given status code.
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Failed to write health response: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// identity describes where hello-app is running. Fields are empty when the
+// information is not available.
+type identity struct {
+	PodName        string `json:"podName,omitempty"`
+	Namespace      string `json:"namespace,omitempty"`
+	NodeName       string `json:"nodeName,omitempty"`
+	PodIP          string `json:"podIP,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	Zone           string `json:"zone,omitempty"`
+	Cluster        string `json:"cluster,omitempty"`
+}
+
+// identityFromEnv reads the identity from the environment variables set
+// through the Kubernetes Downward API, for example:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.name
+func identityFromEnv(getenv func(string) string) identity {
+	return identity{
+		PodName:        getenv("POD_NAME"),
+		Namespace:      getenv("POD_NAMESPACE"),
+		NodeName:       getenv("NODE_NAME"),
+		PodIP:          getenv("POD_IP"),
+		ServiceAccount: getenv("POD_SERVICE_ACCOUNT"),
+		Zone:           getenv("ZONE"),
+		Cluster:        getenv("CLUSTER_NAME"),
+	}
+}
+
+// metadataClient reads instance attributes from the Compute Engine metadata
+// server, or from any server that implements the same paths.
+type metadataClient struct {
+	// baseURL is the address of the metadata server, such as
+	// "http://metadata.google.internal".
+	baseURL string
+	client  *http.Client
+}
+
+// get returns the value of the metadata entry at p, relative to
+// /computeMetadata/v1/.
+func (m *metadataClient) get(ctx context.Context, p string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(m.baseURL, "/")+"/computeMetadata/v1/"+p, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s for %s", resp.Status, p)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// lookupIdentity fills in the zone and cluster name of id from the metadata
+// server at baseURL, unless they are already set. It returns the first error
+// encountered, along with whatever it could resolve.
+func lookupIdentity(ctx context.Context, id identity, baseURL string) (identity, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	m := &metadataClient{baseURL: baseURL, client: http.DefaultClient}
+
+	var firstErr error
+	if id.Zone == "" {
+		// the zone is returned as projects/PROJECT_NUMBER/zones/ZONE
+		zone, err := m.get(ctx, "instance/zone")
+		if err != nil {
+			firstErr = err
+		} else {
+			id.Zone = path.Base(zone)
+		}
+	}
+	if id.Cluster == "" {
+		cluster, err := m.get(ctx, "instance/attributes/cluster-name")
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			id.Cluster = cluster
+		}
+	}
+	return id, firstErr
+}
@@ -0,0 +1,41 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// limit wraps h so that request bodies larger than maxBodyBytes fail to read
+// and handlers running longer than timeout are answered with a 503. A zero
+// value disables the corresponding limit.
+func limit(h http.Handler, maxBodyBytes int64, timeout time.Duration) http.Handler {
+	if timeout > 0 {
+		msg := fmt.Sprintf("503 - Request did not complete within %s\n", timeout)
+		h = http.TimeoutHandler(h, timeout, msg)
+	}
+	if maxBodyBytes > 0 {
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+	return h
+}
@@ -0,0 +1,190 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newLogger returns a logger that writes entries at or above level using the
+// field names recognized by Cloud Logging. format is either "json", for one
+// JSON object per line, or "text", for logfmt-style key=value pairs.
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				a.Key = "severity"
+				a.Value = slog.StringValue(severity(a.Value.Any().(slog.Level)))
+			case slog.MessageKey:
+				a.Key = "message"
+			}
+			return a
+		},
+	}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// fatalf logs an error through the default logger and exits. Unlike
+// log.Fatalf, whose output slog bridges at INFO, the message is written at
+// every LOG_LEVEL.
+func fatalf(format string, args ...any) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// severity maps a slog level to a Cloud Logging severity.
+func severity(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return "ERROR"
+	case l >= slog.LevelWarn:
+		return "WARNING"
+	case l >= slog.LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// parseLevel parses a log level name such as "debug", "info", "warning" or
+// "error".
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// accessLogger writes one structured log entry per request.
+type accessLogger struct {
+	logger *slog.Logger
+	// sampleRate is the fraction of successful requests that are logged.
+	// Requests that fail with a 4xx or 5xx status are always logged.
+	sampleRate float64
+	// project is the Google Cloud project ID used to qualify trace IDs, so
+	// that Cloud Logging can link the entry to Cloud Trace.
+	project string
+	next    http.Handler
+}
+
+func (a *accessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	a.next.ServeHTTP(rec, r)
+	latency := time.Since(start)
+
+	level := slog.LevelInfo
+	switch {
+	case rec.status >= 500:
+		level = slog.LevelError
+	case rec.status >= 400:
+		level = slog.LevelWarn
+	case a.sampleRate < 1 && rand.Float64() >= a.sampleRate:
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.Group("httpRequest",
+			slog.String("requestMethod", r.Method),
+			slog.String("requestUrl", r.URL.String()),
+			slog.Int("status", rec.status),
+			slog.Int64("responseSize", rec.size),
+			slog.String("userAgent", r.UserAgent()),
+			slog.String("remoteIp", peerIP(r)),
+			slog.String("referer", r.Referer()),
+			slog.String("protocol", r.Proto),
+			slog.String("latency", fmt.Sprintf("%.9fs", latency.Seconds())),
+		),
+	}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		traceID := sc.TraceID().String()
+		if a.project != "" {
+			traceID = "projects/" + a.project + "/traces/" + traceID
+		}
+		attrs = append(attrs,
+			slog.String("logging.googleapis.com/trace", traceID),
+			slog.String("logging.googleapis.com/spanId", sc.SpanID().String()),
+			slog.Bool("logging.googleapis.com/trace_sampled", sc.IsSampled()),
+		)
+	}
+	a.logger.LogAttrs(context.Background(), level,
+		fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, rec.status), attrs...)
+}
+
+// peerIP returns the address of the peer of the connection. Forwarding
+// headers such as X-Forwarded-For are not used, since clients can set them
+// to anything.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder captures the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -19,35 +19,308 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 )
 
+// draining is set to 1 once the server has received a termination signal and
+// is waiting for in-flight requests to complete.
+var draining int32
+
 func main() {
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatalf("invalid configuration: %v", err)
+	}
+	logger := newLogger(os.Stdout, cfg.LogFormat, cfg.LogLevel)
+	slog.SetDefault(logger)
+	logger.Info("Loaded configuration", "config", cfg)
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg.TraceEndpoint, cfg.TraceSampleRate)
+	if err != nil {
+		fatalf("failed to set up tracing: %v", err)
+	}
+
+	id := identityFromEnv(os.Getenv)
+	if cfg.MetadataLookup {
+		id, err = lookupIdentity(context.Background(), id, cfg.MetadataURL)
+		if err != nil {
+			log.Printf("Failed to look up instance metadata: %v", err)
+		}
+	}
+	env := hostEnvironment{identity: id}
+
 	// register hello function to handle all requests
+	faultInjector := &faultInjector{faults: cfg.Faults, query: cfg.FaultQuery, maxMemory: cfg.FaultMaxMemory}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", hello)
+	assets := newAssets(cfg.AssetsDir)
+	mux.Handle("/", faultInjector.wrap(hello(cfg.Message, env, assets)))
+	mux.Handle("/static/", staticHandler(assets))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/version", versionHandler)
+	if cfg.Echo {
+		mux.HandleFunc("/echo", echo(cfg.EchoRedact))
+	}
 
-	// use PORT environment variable, or default to 8080
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// serve metrics and fault settings on a separate port if configured, or
+	// alongside hello
+	var admin *http.Server
+	if cfg.MetricsPort != "" && cfg.MetricsPort != cfg.Port {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", metricsHandler())
+		if cfg.FaultAdmin {
+			adminMux.Handle("/admin/faults", faultInjector)
+		}
+		admin = &http.Server{Addr: ":" + cfg.MetricsPort, Handler: adminMux}
+		go func() {
+			log.Printf("Metrics listening on port %s", cfg.MetricsPort)
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatalf("metrics server failed: %v", err)
+			}
+		}()
+	} else {
+		mux.Handle("/metrics", metricsHandler())
+		if cfg.FaultAdmin {
+			mux.Handle("/admin/faults", faultInjector)
+		}
 	}
 
 	// start the web server on port and accept requests
-	log.Printf("Server listening on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, mux))
+	var handler http.Handler = traced(mux, &accessLogger{
+		logger:     logger,
+		sampleRate: cfg.LogSampleRate,
+		project:    cfg.Project,
+		next:       instrument(mux, limit(mux, cfg.MaxBodyBytes, cfg.HandlerTimeout)),
+	})
+	// serve gRPC on a separate port and, with h2c, on the main port as well
+	var grpcServer *grpc.Server
+	var grpcHealth *health.Server
+	if cfg.H2C || cfg.GRPCPort != "" {
+		grpcServer, grpcHealth = newGRPCServer(cfg.Message, env)
+	}
+	if cfg.GRPCPort != "" {
+		lis, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			fatalf("failed to listen for gRPC: %v", err)
+		}
+		go func() {
+			log.Printf("gRPC listening on port %s", cfg.GRPCPort)
+			if err := grpcServer.Serve(lis); err != nil {
+				fatalf("gRPC server failed: %v", err)
+			}
+		}()
+	}
+	if cfg.H2C {
+		handler = withH2C(handler, grpcServer)
+	}
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	go func() {
+		log.Printf("Server version %s listening on port %s", build.Version, cfg.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatalf("server failed: %v", err)
+		}
+	}()
+
+	// wait for a termination signal, then drain in-flight requests
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	log.Printf("Received %s, shutting down", sig)
+	if grpcHealth != nil {
+		grpcHealth.Shutdown()
+	}
+	// the rest of the cleanup still runs if requests outlast the grace period,
+	// so that gRPC streams are closed and the last spans are flushed
+	if err := shutdown(server, cfg.ShutdownDelay, cfg.ShutdownGrace); err != nil {
+		log.Printf("Server shutdown did not complete, closing remaining connections: %v", err)
+		server.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
+	if admin != nil {
+		admin.Close()
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush spans: %v", err)
+	}
+	log.Print("Server stopped")
+}
+
+// shutdown marks the server as draining and keeps serving for delay, so that
+// /readyz fails and load balancers stop routing new requests to this pod
+// before the listener closes. It then waits up to grace for in-flight
+// requests to complete.
+func shutdown(server *http.Server, delay, grace time.Duration) error {
+	atomic.StoreInt32(&draining, 1)
+	if delay > 0 {
+		log.Printf("Failing readiness for %s before shutdown", delay)
+		time.Sleep(delay)
+	}
+	log.Printf("Draining connections for up to %s", grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// isDraining reports whether the server is shutting down.
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// environment reports where hello-app is running. Handlers read it through
+// this interface so that tests can substitute fixed values.
+type environment interface {
+	Hostname() string
+	Identity() identity
+}
+
+// hostEnvironment is the environment of the running process.
+type hostEnvironment struct {
+	identity identity
 }
 
-// hello responds to the request with a plain-text "Hello, world" message.
-func hello(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Serving request: %s", r.URL.Path)
+func (hostEnvironment) Hostname() string {
 	host, _ := os.Hostname()
-	fmt.Fprintf(w, "Hello, world!\n")
-	fmt.Fprintf(w, "Version: 1.0.0\n")
-	fmt.Fprintf(w, "Hostname: %s\n", host)
+	return host
+}
+
+func (e hostEnvironment) Identity() identity {
+	return e.identity
+}
+
+// greeting is the data returned by hello, in whichever format the client asks
+// for.
+type greeting struct {
+	Message  string    `json:"message"`
+	Version  string    `json:"version"`
+	Commit   string    `json:"commit,omitempty"`
+	Hostname string    `json:"hostname"`
+	Path     string    `json:"path"`
+	Pod      *identity `json:"pod,omitempty"`
+}
+
+// page is the data rendered by the landing page template.
+type page struct {
+	greeting
+	// Requests is the number of requests hello has served.
+	Requests uint64
+}
+
+// newGreeting returns the greeting with message for a request to path.
+func newGreeting(message string, env environment, path string) greeting {
+	g := greeting{
+		Message:  message,
+		Version:  build.Version,
+		Commit:   build.Commit,
+		Hostname: env.Hostname(),
+		Path:     path,
+	}
+	if id := env.Identity(); id != (identity{}) {
+		g.Pod = &id
+	}
+	return g
+}
+
+// hello returns a handler that responds to the request with message, such
+// as "Hello, world!", and details about env. The response is plain text
+// unless the Accept header asks for JSON, or HTML rendered from the landing
+// page template in assets.
+func hello(message string, env environment, assets fs.FS) http.HandlerFunc {
+	var requests uint64
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddUint64(&requests, 1)
+		if isDraining() {
+			w.Header().Set("Connection", "close")
+		}
+		g := newGreeting(message, env, r.URL.Path)
+
+		w.Header().Set("Vary", "Accept")
+		switch negotiate(r.Header.Get("Accept"), []string{"text/plain", "application/json", "text/html"}) {
+		case "application/json":
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(g); err != nil {
+				log.Printf("Failed to write response: %v", err)
+			}
+		case "text/html":
+			tmpl, err := loadPage(assets)
+			if err != nil {
+				log.Printf("Failed to load landing page: %v", err)
+				http.Error(w, "500 - Failed to load landing page", http.StatusInternalServerError)
+				return
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, page{greeting: g, Requests: n}); err != nil {
+				log.Printf("Failed to render landing page: %v", err)
+				http.Error(w, "500 - Failed to render landing page", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			buf.WriteTo(w)
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "%s\n", g.Message)
+			fmt.Fprintf(w, "Version: %s\n", g.Version)
+			fmt.Fprintf(w, "Hostname: %s\n", g.Hostname)
+			if g.Pod != nil {
+				for _, f := range []struct{ name, value string }{
+					{"Pod", g.Pod.PodName},
+					{"Namespace", g.Pod.Namespace},
+					{"Node", g.Pod.NodeName},
+					{"Pod IP", g.Pod.PodIP},
+					{"Service account", g.Pod.ServiceAccount},
+					{"Zone", g.Pod.Zone},
+					{"Cluster", g.Pod.Cluster},
+				} {
+					if f.value != "" {
+						fmt.Fprintf(w, "%s: %s\n", f.name, f.value)
+					}
+				}
+			}
+		}
+	}
 }
 
 // [END container_hello_app]
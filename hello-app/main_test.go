@@ -0,0 +1,788 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeEnvironment is an environment with fixed values.
+type fakeEnvironment struct {
+	hostname string
+	identity identity
+}
+
+func (e fakeEnvironment) Hostname() string   { return e.hostname }
+func (e fakeEnvironment) Identity() identity { return e.identity }
+
+// setVersion sets the reported build version for the duration of the test.
+func setVersion(t *testing.T, version string) {
+	t.Helper()
+	old := build
+	build = buildInfo{Version: version}
+	t.Cleanup(func() { build = old })
+}
+
+// setDraining marks the server as draining for the duration of the test.
+func setDraining(t *testing.T) {
+	t.Helper()
+	atomic.StoreInt32(&draining, 1)
+	t.Cleanup(func() { atomic.StoreInt32(&draining, 0) })
+}
+
+func get(t *testing.T, h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHelloText(t *testing.T) {
+	setVersion(t, "1.2.3")
+	tests := []struct {
+		name string
+		env  fakeEnvironment
+		want string
+	}{
+		{
+			name: "host only",
+			env:  fakeEnvironment{hostname: "test-host"},
+			want: "Hello, world!\nVersion: 1.2.3\nHostname: test-host\n",
+		},
+		{
+			name: "pod identity",
+			env: fakeEnvironment{
+				hostname: "test-host",
+				identity: identity{PodName: "hello-1", NodeName: "node-1", Zone: "us-central1-a"},
+			},
+			want: "Hello, world!\nVersion: 1.2.3\nHostname: test-host\n" +
+				"Pod: hello-1\nNode: node-1\nZone: us-central1-a\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(t, hello("Hello, world!", tt.env, embedded), "/", nil)
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want text/plain", got)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want Accept", got)
+			}
+		})
+	}
+}
+
+func TestHelloJSON(t *testing.T) {
+	setVersion(t, "1.2.3")
+	env := fakeEnvironment{hostname: "test-host", identity: identity{Namespace: "default"}}
+	rec := get(t, hello("Hi", env, embedded), "/some/path", http.Header{"Accept": {"application/json"}})
+
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var got greeting
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body, err)
+	}
+	want := greeting{
+		Message:  "Hi",
+		Version:  "1.2.3",
+		Hostname: "test-host",
+		Path:     "/some/path",
+		Pod:      &identity{Namespace: "default"},
+	}
+	if got.Message != want.Message || got.Version != want.Version ||
+		got.Hostname != want.Hostname || got.Path != want.Path ||
+		got.Pod == nil || *got.Pod != *want.Pod {
+		t.Errorf("greeting = %+v, want %+v", got, want)
+	}
+}
+
+func TestHelloHTML(t *testing.T) {
+	setVersion(t, "1.2.3")
+	env := fakeEnvironment{hostname: "<test-host>"}
+	rec := get(t, hello("Hello, world!", env, embedded), "/", http.Header{
+		"Accept": {"text/html,application/xhtml+xml,*/*;q=0.8"},
+	})
+
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html", got)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"<h1>Hello, world!</h1>", "1.2.3", "&lt;test-host&gt;", `<dd id="requests">1</dd>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHelloTemplateOverride(t *testing.T) {
+	assets := overlayFS{
+		upper: fstest.MapFS{
+			pageTemplate: {Data: []byte("<p>{{.Message}} from {{.Hostname}} ({{.Requests}})</p>")},
+		},
+		lower: embedded,
+	}
+	h := hello("Hi", fakeEnvironment{hostname: "test-host"}, assets)
+	accept := http.Header{"Accept": {"text/html"}}
+	get(t, h, "/", accept)
+	if got, want := get(t, h, "/", accept).Body.String(), "<p>Hi from test-host (2)</p>"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	modTime := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	assets := overlayFS{
+		upper: fstest.MapFS{"static/style.css": {Data: []byte("body {}"), ModTime: modTime}},
+		lower: embedded,
+	}
+	h := staticHandler(assets)
+
+	rec := get(t, h, "/static/style.css", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "body {}" {
+		t.Fatalf("overridden file: status = %d, body = %q", rec.Code, rec.Body)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	if got := rec.Header().Get("Last-Modified"); got != modTime.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified = %q, want %q", got, modTime.Format(http.TimeFormat))
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/css") {
+		t.Errorf("Content-Type = %q, want text/css", got)
+	}
+
+	if rec := get(t, h, "/static/style.css", http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec := get(t, h, "/static/app.js", nil); rec.Code != http.StatusOK || rec.Header().Get("Last-Modified") == "" {
+		t.Errorf("embedded file: status = %d, Last-Modified = %q", rec.Code, rec.Header().Get("Last-Modified"))
+	}
+	for _, target := range []string{"/static/missing.css", "/static/", "/static/../templates/hello.html"} {
+		if rec := get(t, h, target, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want %d", target, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestHelloDraining(t *testing.T) {
+	setDraining(t)
+	rec := get(t, hello("Hello, world!", fakeEnvironment{}, embedded), "/", nil)
+	if got := rec.Header().Get("Connection"); got != "close" {
+		t.Errorf("Connection = %q, want close", got)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/plain", "application/json", "text/html"}
+	tests := []struct {
+		accept, want string
+	}{
+		{"", "text/plain"},
+		{"*/*", "text/plain"},
+		{"application/json", "application/json"},
+		{"text/*", "text/plain"},
+		{"text/html, application/json;q=0.9", "text/html"},
+		{"application/json;q=0.5, text/plain;q=0.1", "application/json"},
+		{"text/plain;q=0, */*", "application/json"},
+		{"image/png", "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.accept, offers); got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	setDraining(t)
+	rec := get(t, http.HandlerFunc(healthz), "/healthz", nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d even while draining", rec.Code, http.StatusOK)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name     string
+		draining bool
+		check    error
+		want     int
+		failed   []string
+	}{
+		{name: "ready", want: http.StatusOK},
+		{name: "draining", draining: true, want: http.StatusServiceUnavailable, failed: []string{"shutdown"}},
+		{name: "dependency down", check: errors.New("unreachable"), want: http.StatusServiceUnavailable, failed: []string{"dependency"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.draining {
+				setDraining(t)
+			}
+			old := readinessChecks
+			t.Cleanup(func() { readinessChecks = old })
+			addReadinessCheck("dependency", func(context.Context) error { return tt.check })
+
+			rec := get(t, http.HandlerFunc(readyz), "/readyz", nil)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			var status healthStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+				t.Fatalf("invalid JSON %q: %v", rec.Body, err)
+			}
+			var failed []string
+			for _, c := range status.Checks {
+				if c.Status != "ok" {
+					failed = append(failed, c.Name)
+				}
+			}
+			if strings.Join(failed, ",") != strings.Join(tt.failed, ",") {
+				t.Errorf("failed checks = %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	setVersion(t, "1.2.3")
+	rec := get(t, http.HandlerFunc(versionHandler), "/version", nil)
+	var got buildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body, err)
+	}
+	if got.Version != "1.2.3" {
+		t.Errorf("version = %q, want 1.2.3", got.Version)
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	t.Cleanup(func() { atomic.StoreInt32(&draining, 0) })
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	mux.HandleFunc("/readyz", readyz)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(lis)
+	url := "http://" + lis.Addr().String()
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		result <- string(b)
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- shutdown(server, 200*time.Millisecond, 5*time.Second) }()
+
+	// during the shutdown delay the server still answers, but is not ready
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatalf("GET /readyz during shutdown delay: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/readyz status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	close(release)
+	if got := <-result; got != "done" {
+		t.Errorf("in-flight request got %q, want done", got)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{
+		"PORT":            "9090",
+		"MESSAGE":         "Hi",
+		"READ_TIMEOUT":    "3s",
+		"HANDLER_TIMEOUT": "2s",
+	}
+	cfg, err := loadConfig([]string{"-port", "9191"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "9191" {
+		t.Errorf("port = %q, want the flag to override the environment", cfg.Port)
+	}
+	if cfg.Message != "Hi" || cfg.ReadTimeout != 3*time.Second || cfg.HandlerTimeout != 2*time.Second {
+		t.Errorf("config = %+v, want values from the environment", cfg)
+	}
+
+	for _, args := range [][]string{
+		{"-port", "0"},
+		{"-read-timeout", "-1s"},
+		{"-log-format", "xml"},
+		{"-handler-timeout", "30s", "-write-timeout", "10s"},
+		{"-fault-error-percent", "101"},
+		{"-fault-max-memory", "-1"},
+		{"-fault-memory-bytes", "2048", "-fault-max-memory", "1024"},
+	} {
+		if _, err := loadConfig(args, func(string) string { return "" }); err == nil {
+			t.Errorf("loadConfig(%q) succeeded, want an error", args)
+		}
+	}
+	if _, err := loadConfig(nil, func(k string) string {
+		if k == "IDLE_TIMEOUT" {
+			return "soon"
+		}
+		return ""
+	}); err == nil {
+		t.Error("loadConfig with IDLE_TIMEOUT=soon succeeded, want an error")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	h := limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+		}
+	}), 8, 50*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("more than eight bytes")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	rec = get(t, h, "/slow", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("slow handler: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := &accessLogger{
+		logger:     newLogger(&buf, "json", slog.LevelInfo),
+		sampleRate: 0,
+		project:    "my-project",
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fail" {
+				http.Error(w, "boom", http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(w, "ok")
+		}),
+	}
+
+	// successful requests are sampled out with a sample rate of 0
+	get(t, h, "/", nil)
+	if buf.Len() != 0 {
+		t.Errorf("sampled out request was logged: %s", buf.String())
+	}
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	req := httptest.NewRequest(http.MethodGet, "/fail?x=1", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	// the client-supplied X-Forwarded-For is not logged as the remote IP
+	req.Header.Set("X-Forwarded-For", "203.0.113.1, 10.0.0.1")
+	req = req.WithContext(trace.ContextWithSpanContext(req.Context(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry struct {
+		Severity    string `json:"severity"`
+		Message     string `json:"message"`
+		HTTPRequest struct {
+			RequestMethod string `json:"requestMethod"`
+			RequestURL    string `json:"requestUrl"`
+			Status        int    `json:"status"`
+			ResponseSize  int64  `json:"responseSize"`
+			UserAgent     string `json:"userAgent"`
+			RemoteIP      string `json:"remoteIp"`
+			Latency       string `json:"latency"`
+		} `json:"httpRequest"`
+		Trace        string `json:"logging.googleapis.com/trace"`
+		SpanID       string `json:"logging.googleapis.com/spanId"`
+		TraceSampled bool   `json:"logging.googleapis.com/trace_sampled"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid log entry %q: %v", buf.String(), err)
+	}
+	if entry.Severity != "ERROR" || entry.Message != "GET /fail 500" {
+		t.Errorf("severity, message = %q, %q, want ERROR, GET /fail 500", entry.Severity, entry.Message)
+	}
+	r := entry.HTTPRequest
+	if r.RequestMethod != "GET" || r.RequestURL != "/fail?x=1" || r.Status != 500 ||
+		r.ResponseSize != int64(len("boom\n")) || r.UserAgent != "test-agent" || r.RemoteIP != "192.0.2.1" {
+		t.Errorf("httpRequest = %+v", r)
+	}
+	if !strings.HasSuffix(r.Latency, "s") {
+		t.Errorf("latency = %q, want a duration in seconds", r.Latency)
+	}
+	if entry.Trace != "projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736" ||
+		entry.SpanID != "00f067aa0ba902b7" || !entry.TraceSampled {
+		t.Errorf("trace fields = %q, %q, %t", entry.Trace, entry.SpanID, entry.TraceSampled)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	oldProvider, oldPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(oldProvider)
+		otel.SetTextMapPropagator(oldPropagator)
+	})
+	if _, err := setupTracing(context.Background(), "", 1); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	var logged trace.SpanContext
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items/", func(w http.ResponseWriter, r *http.Request) {
+		logged = trace.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := traced(mux, mux)
+
+	get(t, h, "/items/1", http.Header{
+		"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	})
+	get(t, h, "/missing", nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /items/" {
+		t.Errorf("span name = %q, want %q", span.Name, "GET /items/")
+	}
+	if span.SpanKind != trace.SpanKindServer {
+		t.Errorf("span kind = %v, want server", span.SpanKind)
+	}
+	if got := span.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the one from traceparent", got)
+	}
+	if got := span.Parent.SpanID().String(); got != "00f067aa0ba902b7" || !span.Parent.IsRemote() {
+		t.Errorf("parent span ID = %s (remote %t), want remote 00f067aa0ba902b7", got, span.Parent.IsRemote())
+	}
+	if logged.SpanID() != span.SpanContext.SpanID() {
+		t.Errorf("handler saw span %s, want %s", logged.SpanID(), span.SpanContext.SpanID())
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs["http.method"]; v.AsString() != "GET" {
+		t.Errorf("http.method = %q, want GET", v.AsString())
+	}
+	if v := attrs["http.status_code"]; v.AsInt64() != http.StatusTeapot {
+		t.Errorf("http.status_code = %d, want %d", v.AsInt64(), http.StatusTeapot)
+	}
+	if got := spans[1].Name; got != "GET unmatched" {
+		t.Errorf("unmatched span name = %q, want %q", got, "GET unmatched")
+	}
+}
+
+func TestTracingExportsOTLP(t *testing.T) {
+	oldProvider, oldPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(oldProvider)
+		otel.SetTextMapPropagator(oldPropagator)
+	})
+
+	// a stand-in for an OpenTelemetry collector's OTLP/HTTP receiver
+	received := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/otlp/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("export to %s with Content-Type %q, want /otlp/v1/traces and application/x-protobuf",
+				r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("invalid export request: %v", err)
+		}
+		received <- req
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	shutdownTracing, err := setupTracing(context.Background(), collector.URL+"/otlp", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items/", func(w http.ResponseWriter, r *http.Request) {})
+	get(t, traced(mux, mux), "/items/1", nil)
+	if err := shutdownTracing(context.Background()); err != nil {
+		t.Fatalf("flushing spans: %v", err)
+	}
+
+	select {
+	case req := <-received:
+		var names []string
+		for _, rs := range req.GetResourceSpans() {
+			for _, ss := range rs.GetScopeSpans() {
+				for _, span := range ss.GetSpans() {
+					names = append(names, span.GetName())
+				}
+			}
+		}
+		if len(names) != 1 || names[0] != "GET /items/" {
+			t.Errorf("exported spans = %q, want [GET /items/]", names)
+		}
+	default:
+		t.Fatal("no spans were exported")
+	}
+}
+
+func TestEchoRedactsHeaders(t *testing.T) {
+	rec := get(t, echo([]string{"authorization"}), "/echo?x=1", http.Header{
+		"Authorization":   {"Bearer secret"},
+		"X-Forwarded-For": {"203.0.113.1"},
+	})
+	var got echoRequest
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body, err)
+	}
+	if v := got.Headers["Authorization"]; len(v) != 1 || v[0] != redacted {
+		t.Errorf("Authorization = %q, want it redacted", v)
+	}
+	if v := got.Forwarded["X-Forwarded-For"]; len(v) != 1 || v[0] != "203.0.113.1" {
+		t.Errorf("forwarded X-Forwarded-For = %q, want 203.0.113.1", v)
+	}
+	if got.URL != "http://example.com/echo?x=1" {
+		t.Errorf("url = %q, want http://example.com/echo?x=1", got.URL)
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fi := &faultInjector{
+		faults:    faults{ErrorPercent: 100, ErrorCode: http.StatusBadGateway, LatencyDistribution: "fixed"},
+		query:     true,
+		maxMemory: 1024,
+	}
+	if rec := get(t, fi.wrap(ok), "/", nil); rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if rec := get(t, fi.wrap(ok), "/?fault-error=0", nil); rec.Code != http.StatusOK {
+		t.Errorf("with query override: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := get(t, fi.wrap(ok), "/?fault-latency=soon", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("with invalid query: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	for _, q := range []string{"fault-memory=-1", "fault-memory=1025"} {
+		if rec := get(t, fi.wrap(ok), "/?fault-error=0&"+q, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("with %s: status = %d, want %d", q, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if rec := get(t, fi.wrap(ok), "/?fault-error=0&fault-memory=1024", nil); rec.Code != http.StatusOK {
+		t.Errorf("with memory at the cap: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/admin/faults", strings.NewReader(`{"memoryBytes":1025}`))
+	rec := httptest.NewRecorder()
+	fi.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("admin update above the memory cap: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	drop := &faultInjector{faults: faults{DropPercent: 100, ErrorCode: 500, LatencyDistribution: "fixed"}}
+	before := testutil.ToFloat64(faultsInjected.WithLabelValues("drop"))
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want http.ErrAbortHandler", r)
+			}
+		}()
+		get(t, drop.wrap(ok), "/", nil)
+	}()
+	if got := testutil.ToFloat64(faultsInjected.WithLabelValues("drop")) - before; got != 1 {
+		t.Errorf("drops counted = %g, want 1", got)
+	}
+}
+
+func TestH2CGRPC(t *testing.T) {
+	env := fakeEnvironment{hostname: "test-host"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", hello("Hello, world!", env, nil))
+	g, _ := newGRPCServer("Hello, gRPC!", env)
+	defer g.Stop()
+	srv := httptest.NewServer(withH2C(mux, g))
+	defer srv.Close()
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(srv.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp := &structpb.Struct{}
+	if err := conn.Invoke(ctx, "/hello.v1.Hello/SayHello", &emptypb.Empty{}, resp); err != nil {
+		t.Fatalf("SayHello: %v", err)
+	}
+	fields := resp.GetFields()
+	if got := fields["message"].GetStringValue(); got != "Hello, gRPC!" {
+		t.Errorf("message = %q, want Hello, gRPC!", got)
+	}
+	if got := fields["hostname"].GetStringValue(); got != "test-host" {
+		t.Errorf("hostname = %q, want test-host", got)
+	}
+	if got := fields["path"].GetStringValue(); got != "/hello.v1.Hello/SayHello" {
+		t.Errorf("path = %q, want /hello.v1.Hello/SayHello", got)
+	}
+
+	// plain HTTP/1.1 requests still reach the mux
+	res, err := srv.Client().Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.ProtoMajor != 1 || res.StatusCode != http.StatusOK {
+		t.Errorf("HTTP/1.1 request: proto = %s, status = %d, want HTTP/1.1 200", res.Proto, res.StatusCode)
+	}
+	if !strings.Contains(string(body), "Hello, world!") {
+		t.Errorf("HTTP/1.1 body = %q, want the hello response", body)
+	}
+}
+
+func TestH2CGRPCStreamOutlivesServerTimeouts(t *testing.T) {
+	g, hs := newGRPCServer("Hello, gRPC!", fakeEnvironment{hostname: "test-host"})
+	defer g.Stop()
+	srv := httptest.NewUnstartedServer(withH2C(http.NotFoundHandler(), g))
+	srv.Config.ReadTimeout = 200 * time.Millisecond
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(srv.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{Service: "hello.v1.Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("first Watch response = %v, %v, want SERVING", resp, err)
+	}
+
+	// the stream stays open past the server's read and write timeouts
+	time.Sleep(500 * time.Millisecond)
+	hs.SetServingStatus("hello.v1.Hello", healthpb.HealthCheckResponse_NOT_SERVING)
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("Watch response after the timeouts = %v, %v, want NOT_SERVING", resp, err)
+	}
+}
+
+func TestLookupIdentity(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/zone":
+			io.WriteString(w, "projects/123/zones/us-central1-a")
+		case "/computeMetadata/v1/instance/attributes/cluster-name":
+			io.WriteString(w, "demo-cluster")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer metadata.Close()
+
+	id, err := lookupIdentity(context.Background(), identity{PodName: "hello-1"}, metadata.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := identity{PodName: "hello-1", Zone: "us-central1-a", Cluster: "demo-cluster"}
+	if id != want {
+		t.Errorf("identity = %+v, want %+v", id, want)
+	}
+}
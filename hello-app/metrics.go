@@ -0,0 +1,117 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	reg = prometheus.NewRegistry()
+
+	requestCount = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hello_app_requests_total",
+			Help: "Total number of HTTP requests by route, status code and method.",
+		},
+		[]string{"route", "code", "method"},
+	)
+	requestDuration = promauto.With(reg).NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hello_app_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route, status code and method.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "code", "method"},
+	)
+	responseSize = promauto.With(reg).NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hello_app_response_size_bytes",
+			Help:    "Size of HTTP responses by route, status code and method.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		},
+		[]string{"route", "code", "method"},
+	)
+	inFlight = promauto.With(reg).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hello_app_requests_in_flight",
+			Help: "Number of HTTP requests currently being served.",
+		},
+	)
+	faultsInjected = promauto.With(reg).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hello_app_faults_injected_total",
+			Help: "Total number of injected faults by type (error or drop).",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// metricsHandler serves the metrics in reg in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
+}
+
+// instrumentedMux records Prometheus metrics for every request served by next,
+// labeled with the mux pattern that matches the request.
+type instrumentedMux struct {
+	mux      *http.ServeMux
+	next     http.Handler
+	handlers sync.Map // route pattern -> http.Handler
+}
+
+// instrument wraps next, which dispatches requests through mux, in a
+// middleware that records request metrics.
+func instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerInFlight(inFlight, &instrumentedMux{mux: mux, next: next})
+}
+
+func (m *instrumentedMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, route := m.mux.Handler(r)
+	if route == "" {
+		// keep label cardinality bounded for requests no route matched
+		route = "unmatched"
+	}
+	h, ok := m.handlers.Load(route)
+	if !ok {
+		labels := prometheus.Labels{"route": route}
+		h, _ = m.handlers.LoadOrStore(route, promhttp.InstrumentHandlerDuration(
+			requestDuration.MustCurryWith(labels),
+			promhttp.InstrumentHandlerCounter(
+				requestCount.MustCurryWith(labels),
+				promhttp.InstrumentHandlerResponseSize(
+					responseSize.MustCurryWith(labels),
+					m.next,
+				),
+			),
+		))
+	}
+	h.(http.Handler).ServeHTTP(w, r)
+}
@@ -0,0 +1,90 @@
+/**
+ * Copyright 2021 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiate returns the entry of offers that best matches the Accept header
+// value accept, following the quality values and wildcards of RFC 9110: each
+// offer takes the quality of the most specific media range that matches it.
+// Ties are broken by the order of offers. When accept is empty or nothing
+// matches, the first offer is returned.
+func negotiate(accept string, offers []string) string {
+	if accept == "" {
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		value string
+		q     float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		value, q := parseMediaRange(part)
+		ranges = append(ranges, mediaRange{value, q})
+	}
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			if s := matchMediaRange(r.value, offer); s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// parseMediaRange splits one element of an Accept header into its media range
+// and quality value. Parameters other than q are ignored.
+func parseMediaRange(s string) (string, float64) {
+	params := strings.Split(s, ";")
+	mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+	q := 1.0
+	for _, p := range params[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "q" {
+			continue
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+			q = f
+		}
+	}
+	return mediaRange, q
+}
+
+// matchMediaRange reports how specifically mediaRange matches the media type
+// offer: 2 for an exact match, 1 for type/*, 0 for */* and -1 for no match.
+func matchMediaRange(mediaRange, offer string) int {
+	switch {
+	case mediaRange == offer:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") &&
+		strings.HasPrefix(offer, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,27 @@
+/**
+ * Copyright 2021 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Ask the server again without reloading the page, and highlight the hostname
+// when a different pod answers.
+document.getElementById('refresh').addEventListener('click', async () => {
+  const resp = await fetch(window.location.pathname, {
+    headers: {Accept: 'application/json'},
+  });
+  const greeting = await resp.json();
+  const hostname = document.getElementById('hostname');
+  hostname.classList.toggle('changed', hostname.textContent !== greeting.hostname);
+  hostname.textContent = greeting.hostname;
+});